@@ -16,11 +16,15 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
 	"github.com/derrickmartinez/wireguard-auth/pkg/mfa"
+	"github.com/derrickmartinez/wireguard-auth/pkg/policy"
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
 	"github.com/derrickmartinez/wireguard-auth/pkg/user"
 	"github.com/derrickmartinez/wireguard-auth/pkg/util"
 	"github.com/rs/zerolog"
@@ -60,8 +64,13 @@ var authCmd = &cobra.Command{
 	Use:   "auth",
 	Short: "Authenticate a user using 2FA",
 	Run: func(cmd *cobra.Command, args []string) {
+		policy.CheckConfig()
+		if err := mfa.CheckConfig(); err != nil {
+			log.Error().Err(err).Msg("Invalid configuration")
+			exit(1)
+		}
 		if !mfa.Validate(&cfgVars, awsSession()) {
-			os.Exit(1)
+			exit(1)
 		}
 	},
 }
@@ -74,7 +83,9 @@ var addUserCmd = &cobra.Command{
 			fmt.Println("Error: You must specify a rule or routes")
 			os.Exit(1)
 		}
-		user.Add(&cfgVars, awsSession())
+		if !user.Add(&cfgVars, awsSession()) {
+			exit(1)
+		}
 	},
 }
 
@@ -82,15 +93,19 @@ var removeUserCmd = &cobra.Command{
 	Use:   "remove",
 	Short: "Remove a user from the database",
 	Run: func(cmd *cobra.Command, args []string) {
-		user.Remove(&cfgVars, awsSession())
+		if !user.Remove(&cfgVars, awsSession()) {
+			exit(1)
+		}
 	},
 }
 
 var syncCmd = &cobra.Command{
 	Use:   "sync",
-	Short: "Sync wireguard with dynamodb (runs in foreground)",
+	Short: "Sync every server's wireguard interface with dynamodb (runs in foreground)",
 	Run: func(cmd *cobra.Command, args []string) {
-		user.Sync(&cfgVars, awsSession())
+		if !user.Sync(context.Background(), &cfgVars, awsSession()) {
+			exit(1)
+		}
 	},
 }
 
@@ -110,7 +125,9 @@ var updateRoutesCmd = &cobra.Command{
 			fmt.Println("Error: You must specify a rule or routes")
 			os.Exit(1)
 		}
-		user.UpdateRoutes(&cfgVars, awsSession())
+		if !user.UpdateRoutes(&cfgVars, awsSession()) {
+			exit(1)
+		}
 	},
 }
 
@@ -118,7 +135,201 @@ var resendEmailCmd = &cobra.Command{
 	Use:   "resend-email",
 	Short: "Email config to user again",
 	Run: func(cmd *cobra.Command, args []string) {
-		user.ResendEmail(&cfgVars, awsSession())
+		if !user.ResendEmail(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var refreshIdpCmd = &cobra.Command{
+	Use:   "refresh-idp",
+	Short: "Refresh cached identity provider IDs (all users unless --profile is set)",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.RefreshIdp(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var revokeGraceCmd = &cobra.Command{
+	Use:   "revoke-grace",
+	Short: "Forget remembered devices so the user's next connection requires MFA",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.RevokeGrace(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Lift an MFA lockout and reset the user's rate limits",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Unlock(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var rotateKeysCmd = &cobra.Command{
+	Use:   "rotate-keys",
+	Short: "Issue a user a new keypair and preshared key, keeping the IP and routes",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.RotateKeys(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var rotateServerKeyCmd = &cobra.Command{
+	Use:   "rotate-server-key",
+	Short: "Stage the server's nextPrivateKey, email every user the new config and switch at --at",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.RotateServerKey(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var cancelServerKeyCmd = &cobra.Command{
+	Use:   "cancel-server-key",
+	Short: "Drop a staged server key before the switch",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.CancelServerKey(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var serverKeyStatusCmd = &cobra.Command{
+	Use:   "server-key-status",
+	Short: "Show a staged server key and which users received the new config",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.ServerKeyStatus(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var identitiesCmd = &cobra.Command{
+	Use:   "identities",
+	Short: "List users with their identity provider groups and devices",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Identities(awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var removeIdentityCmd = &cobra.Command{
+	Use:   "remove-identity",
+	Short: "Remove a user and every device registered to them",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.RemoveIdentity(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var setDeviceLimitCmd = &cobra.Command{
+	Use:   "set-device-limit",
+	Short: "Set how many devices a user may register",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.SetDeviceLimit(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var disableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Stop a user connecting while keeping their IP and keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Disable(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var enableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Let a disabled user connect again",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Enable(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var grantCmd = &cobra.Command{
+	Use:   "grant",
+	Short: "Give a user extra routes for a limited time",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.AddGrant(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var reconcileIdpCmd = &cobra.Command{
+	Use:   "reconcile-idp",
+	Short: "Disable or remove users that are suspended, deprovisioned or out of the allowed groups in the identity provider",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.ReconcileIdp(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Build the profile name and device indexes and report duplicate profiles",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Reindex(awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var teardownCmd = &cobra.Command{
+	Use:   "teardown",
+	Short: "Remove every peer and firewall chain created by wireguard-auth on this host",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Teardown(&cfgVars, awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var gatewaysCmd = &cobra.Command{
+	Use:   "gateways",
+	Short: "Show the gateways running sync, the leader, and which peers are connected where",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !user.Gateways(awsSession()) {
+			exit(1)
+		}
+	},
+}
+
+var initServerCmd = &cobra.Command{
+	Use:   "init-server",
+	Short: "Create and configure the wireguard interface and enable forwarding",
+	Run: func(cmd *cobra.Command, args []string) {
+		servers, err := server.All()
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid server config")
+			exit(1)
+		}
+		for _, v := range servers {
+			if cfgVars.Server != "" && v.Name != cfgVars.Server {
+				continue
+			}
+			if err := server.EnsureInterface(user.EffectiveServer(v, awsSession())); err != nil {
+				log.Error().Err(err).Msgf("Unable to set up the wireguard interface for %v", v.Name)
+				exit(1)
+			}
+			log.Info().Msgf("Wireguard interface %v ready", v.WgInterface)
+		}
 	},
 }
 
@@ -138,8 +349,15 @@ func awsSession() *dynamodb.DynamoDB {
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		exit(1)
 	}
+	audit.Close()
+}
+
+// Flush audit events before exiting
+func exit(code int) {
+	audit.Close()
+	os.Exit(code)
 }
 
 func init() {
@@ -151,6 +369,10 @@ func init() {
 	addUserCmd.Flags().StringVar(&cfgVars.Rule, "rule", "", "Use a routing rule (optional)")
 	addUserCmd.Flags().StringVar(&cfgVars.Routes, "routes", "", "Allow routes separated by comma with or without port/proto i.e. 1.1.1.1/32->22/tcp,2.0.0.0/8 (optional)")
 	addUserCmd.Flags().StringVar(&cfgVars.Email, "email", "", "Email")
+	addUserCmd.Flags().StringVar(&cfgVars.Server, "server", "", "Server to add the user to (default the first server)")
+	addUserCmd.Flags().StringVar(&cfgVars.Device, "device", "", "Device name, for users with more than one device (optional)")
+	addUserCmd.Flags().StringVar(&cfgVars.Expires, "expires", "", "Date or RFC 3339 time access ends i.e. 2026-12-31 (optional)")
+	addUserCmd.Flags().StringVar(&cfgVars.TTL, "ttl", "", "Duration until access ends i.e. 72h (optional)")
 	addUserCmd.MarkFlagRequired("profile")
 	addUserCmd.MarkFlagRequired("email")
 	rootCmd.AddCommand(addUserCmd)
@@ -159,10 +381,19 @@ func init() {
 	removeUserCmd.MarkFlagRequired("profile")
 	rootCmd.AddCommand(removeUserCmd)
 
+	disableCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
+	disableCmd.Flags().StringVar(&cfgVars.Reason, "reason", "", "Why the user is disabled, shown by list (optional)")
+	disableCmd.MarkFlagRequired("profile")
+	rootCmd.AddCommand(disableCmd)
+	enableCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
+	enableCmd.MarkFlagRequired("profile")
+	rootCmd.AddCommand(enableCmd)
+
 	authCmd.Flags().StringVar(&cfgVars.PubKey, "pubkey", "", "Pubkey of the vpn user")
 	authCmd.Flags().StringVar(&cfgVars.Endpoint, "endpoint", "", "Endpoint of the user authenticating")
 	authCmd.MarkFlagRequired("pubkey")
 	rootCmd.AddCommand(authCmd)
+	syncCmd.Flags().BoolVar(&cfgVars.TeardownOnExit, "teardown-on-exit", false, "Remove managed peers and firewall chains when sync stops")
 	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(listCmd)
 
@@ -175,6 +406,53 @@ func init() {
 	resendEmailCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
 	resendEmailCmd.MarkFlagRequired("profile")
 	rootCmd.AddCommand(resendEmailCmd)
+
+	refreshIdpCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name (optional)")
+	rootCmd.AddCommand(refreshIdpCmd)
+
+	revokeGraceCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
+	revokeGraceCmd.MarkFlagRequired("profile")
+	rootCmd.AddCommand(revokeGraceCmd)
+
+	unlockCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
+	unlockCmd.MarkFlagRequired("profile")
+	rootCmd.AddCommand(unlockCmd)
+
+	rotateKeysCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
+	rotateKeysCmd.MarkFlagRequired("profile")
+	rootCmd.AddCommand(rotateKeysCmd)
+
+	grantCmd.Flags().StringVar(&cfgVars.ProfileName, "profile", "", "Profile name")
+	grantCmd.Flags().StringVar(&cfgVars.Routes, "routes", "", "Routes separated by comma with or without port/proto i.e. 1.1.1.1/32->22/tcp,2.0.0.0/8")
+	grantCmd.Flags().StringVar(&cfgVars.For, "for", "", "How long the routes are allowed i.e. 4h")
+	grantCmd.MarkFlagRequired("profile")
+	grantCmd.MarkFlagRequired("routes")
+	grantCmd.MarkFlagRequired("for")
+	rootCmd.AddCommand(grantCmd)
+
+	rotateServerKeyCmd.Flags().StringVar(&cfgVars.Server, "server", "", "Server (default the first server)")
+	rotateServerKeyCmd.Flags().StringVar(&cfgVars.SwitchAt, "at", "", "RFC 3339 time to switch to the new key (default now + serverKeys.switchDelay)")
+	rootCmd.AddCommand(rotateServerKeyCmd)
+	cancelServerKeyCmd.Flags().StringVar(&cfgVars.Server, "server", "", "Server (default the first server)")
+	rootCmd.AddCommand(cancelServerKeyCmd)
+	serverKeyStatusCmd.Flags().StringVar(&cfgVars.Server, "server", "", "Server (default the first server)")
+	rootCmd.AddCommand(serverKeyStatusCmd)
+
+	rootCmd.AddCommand(identitiesCmd)
+	removeIdentityCmd.Flags().StringVar(&cfgVars.Email, "email", "", "Email")
+	removeIdentityCmd.MarkFlagRequired("email")
+	rootCmd.AddCommand(removeIdentityCmd)
+	setDeviceLimitCmd.Flags().StringVar(&cfgVars.Email, "email", "", "Email")
+	setDeviceLimitCmd.Flags().IntVar(&cfgVars.MaxDevices, "max", 0, "Devices allowed, 0 for the devices.maxPerUser default")
+	setDeviceLimitCmd.MarkFlagRequired("email")
+	rootCmd.AddCommand(setDeviceLimitCmd)
+	rootCmd.AddCommand(reindexCmd)
+	reconcileIdpCmd.Flags().BoolVar(&cfgVars.DryRun, "dry-run", false, "Only report what would change")
+	rootCmd.AddCommand(reconcileIdpCmd)
+	rootCmd.AddCommand(teardownCmd)
+	rootCmd.AddCommand(gatewaysCmd)
+	initServerCmd.Flags().StringVar(&cfgVars.Server, "server", "", "Only set up this server (default all servers)")
+	rootCmd.AddCommand(initServerCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"os"
+	osuser "os/user"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Results used across events
+const (
+	Success = "success"
+	Failure = "failure"
+	Allowed = "allowed"
+	Denied  = "denied"
+)
+
+// One auditable action, either an authentication or an admin change
+type Event struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Profile  string    `json:"profile,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	Result   string    `json:"result"`
+	Detail   string    `json:"detail,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	RemoteIP string    `json:"remoteIP,omitempty"`
+	Geo      *Geo      `json:"geo,omitempty"`
+}
+
+type Geo struct {
+	City    string  `json:"city,omitempty"`
+	Country string  `json:"country,omitempty"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	ASN     uint    `json:"asn,omitempty"`
+}
+
+// A destination for audit events
+type Sink interface {
+	Send(e Event) error
+	Close() error
+}
+
+var (
+	sinks []Sink
+	once  sync.Once
+	mu    sync.Mutex
+)
+
+// Build the sinks enabled in config
+func open() {
+	if viper.GetBool("splunk.enabled") {
+		if s, err := newSplunkSink(); err != nil {
+			log.Error().Err(err).Msg("Unable to create Splunk audit sink")
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if viper.GetBool("loki.enabled") {
+		if s, err := newLokiSink(); err != nil {
+			log.Error().Err(err).Msg("Unable to create Loki audit sink")
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if viper.GetBool("audit.file.enabled") {
+		if s, err := newFileSink(viper.GetString("audit.file.path")); err != nil {
+			log.Error().Err(err).Msg("Unable to open audit file")
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if viper.GetBool("audit.syslog.enabled") {
+		if s, err := newSyslogSink(); err != nil {
+			log.Error().Err(err).Msg("Unable to connect to syslog")
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+}
+
+// Send an event to every configured sink. Sink errors are logged and never
+// block the action being audited.
+func Emit(e Event) {
+	once.Do(open)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Actor == "" {
+		e.Actor = Actor()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range sinks {
+		if err := s.Send(e); err != nil {
+			log.Error().Err(err).Msgf("Unable to send audit event to %T", s)
+		}
+	}
+}
+
+// Record the outcome of an admin command
+func Admin(action string, profile string, ok bool, detail string) {
+	result := Success
+	if !ok {
+		result = Failure
+	}
+	Emit(Event{Action: action, Profile: profile, Result: result, Detail: detail})
+}
+
+// Flush and close all sinks. Call before the process exits.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			log.Error().Err(err).Msgf("Unable to close %T", s)
+		}
+	}
+	sinks = nil
+}
+
+// The operator running the command, preferring the user behind sudo
+func Actor() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := osuser.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
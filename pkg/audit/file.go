@@ -0,0 +1,31 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Appends one JSON document per line
+type fileSink struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	if path == "" {
+		path = "/var/log/wireguard-auth/audit.jsonl"
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *fileSink) Send(e Event) error {
+	return s.enc.Encode(e)
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/promtail"
+
+	"github.com/spf13/viper"
+)
+
+type lokiSink struct {
+	client promtail.Client
+}
+
+func newLokiSink() (*lokiSink, error) {
+	labels := make(map[string]string)
+	labels["source"] = "wireguard-vpn"
+	labels["job"] = "vpn"
+
+	// ClientConfig reads 0 as the default, so an explicit 0 needs NoRetries
+	maxRetries := viper.GetInt("loki.maxRetries")
+	if maxRetries == 0 && viper.IsSet("loki.maxRetries") {
+		maxRetries = promtail.NoRetries
+	}
+
+	cfg := promtail.ClientConfig{
+		PushURL:            viper.GetString("loki.pushURL"),
+		Authorization:      viper.GetString("loki.basicAuth"),
+		Labels:             labels,
+		Format:             promtail.ParseFormat(viper.GetString("loki.format")),
+		BatchWait:          1 * time.Second,
+		BatchEntriesNumber: 1000,
+		SendLevel:          promtail.INFO,
+		PrintLevel:         promtail.INFO,
+		MaxRetries:         maxRetries,
+		SpoolDir:           viper.GetString("loki.spoolDir"),
+		SpoolMaxBytes:      viper.GetInt64("loki.spoolMaxBytes"),
+		ShutdownTimeout:    time.Second * time.Duration(viper.GetInt("loki.shutdownTimeout")),
+	}
+	client, err := promtail.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &lokiSink{client: client}, nil
+}
+
+// Each event is one JSON line; the fields worth filtering on become labels
+func (s *lokiSink) Send(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{
+		"action":  e.Action,
+		"result":  e.Result,
+		"profile": e.Profile,
+	}
+	if e.Geo != nil {
+		labels["country"] = e.Geo.Country
+	}
+	s.client.Log(promtail.INFO, labels, string(line))
+	return nil
+}
+
+func (s *lokiSink) Close() error {
+	s.client.Shutdown()
+	return nil
+}
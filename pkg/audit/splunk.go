@@ -0,0 +1,274 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultSplunkPath      = "/services/collector"
+	defaultSplunkBatchSize = 50
+	defaultSplunkBatchWait = 5 * time.Second
+	defaultSplunkAckWait   = 30 * time.Second
+)
+
+// A long-lived HTTP Event Collector client. Events are batched until
+// splunk.batchSize is reached, splunk.batchWait passes or the sink is closed.
+type splunkSink struct {
+	client    *http.Client
+	url       string
+	ackURL    string
+	token     string
+	channel   string
+	ack       bool
+	ackWait   time.Duration
+	host      string
+	batchSize int
+	batchWait time.Duration
+
+	mu    sync.Mutex
+	batch []hecEvent
+	timer *time.Timer
+	// Held while a batch is posted, keeping batches in order and making
+	// Close wait for one in flight
+	sending sync.Mutex
+}
+
+// The HEC envelope. Fields are indexed so searches don't need to parse the event.
+type hecEvent struct {
+	Time       float64           `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      Event             `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+func newSplunkSink() (*splunkSink, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: viper.GetBool("splunk.insecureSkipVerify")}
+	if caFile := viper.GetString("splunk.caFile"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	base := "https://" + viper.GetString("splunk.server")
+	if port := viper.GetInt("splunk.port"); port != 0 {
+		base += ":" + strconv.Itoa(port)
+	}
+	path := viper.GetString("splunk.path")
+	if path == "" {
+		path = defaultSplunkPath
+	}
+
+	s := &splunkSink{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		url:       base + path,
+		ackURL:    base + ackPath(path),
+		token:     viper.GetString("splunk.token"),
+		ack:       viper.GetBool("splunk.ack"),
+		ackWait:   time.Second * time.Duration(viper.GetInt("splunk.ackTimeout")),
+		batchSize: viper.GetInt("splunk.batchSize"),
+		batchWait: time.Second * time.Duration(viper.GetInt("splunk.batchWait")),
+	}
+	s.host, _ = os.Hostname()
+	if s.batchSize <= 0 {
+		s.batchSize = defaultSplunkBatchSize
+	}
+	if s.batchWait <= 0 {
+		s.batchWait = defaultSplunkBatchWait
+	}
+	if s.ackWait <= 0 {
+		s.ackWait = defaultSplunkAckWait
+	}
+	if s.ack {
+		s.channel = newChannel()
+	}
+	return s, nil
+}
+
+func (s *splunkSink) Send(e Event) error {
+	fields := map[string]string{
+		"action":  e.Action,
+		"actor":   e.Actor,
+		"result":  e.Result,
+		"profile": e.Profile,
+	}
+	if e.Geo != nil && e.Geo.Country != "" {
+		fields["country"] = e.Geo.Country
+	}
+
+	s.mu.Lock()
+	s.batch = append(s.batch, hecEvent{
+		Time:       float64(e.Time.UnixNano()) / float64(time.Second),
+		Host:       s.host,
+		Source:     viper.GetString("splunk.source"),
+		SourceType: viper.GetString("splunk.sourcetype"),
+		Index:      viper.GetString("splunk.index"),
+		Event:      e,
+		Fields:     fields,
+	})
+	full := len(s.batch) >= s.batchSize
+	if !full && s.timer == nil {
+		s.timer = time.AfterFunc(s.batchWait, func() {
+			if err := s.flush(); err != nil {
+				log.Error().Err(err).Msg("Unable to send events to Splunk")
+			}
+		})
+	}
+	s.mu.Unlock()
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *splunkSink) Close() error {
+	return s.flush()
+}
+
+// Send the pending batch. mu is only held while taking the batch, so Send
+// never waits for Splunk.
+func (s *splunkSink) flush() error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	batch := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	err := s.post(body.Bytes())
+	if err != nil && s.ack {
+		// Unacknowledged events may not be indexed, send them once more
+		log.Warn().Err(err).Msg("Splunk did not acknowledge events, resending")
+		err = s.post(body.Bytes())
+	}
+	return err
+}
+
+func (s *splunkSink) post(body []byte) error {
+	resp := hecResponse{}
+	if err := s.do(s.url, body, &resp); err != nil {
+		return err
+	}
+	if !s.ack {
+		return nil
+	}
+	if resp.AckID == nil {
+		return errors.New("indexer acknowledgement is not enabled on the HEC token")
+	}
+	return s.waitForAck(*resp.AckID)
+}
+
+// Poll the ack endpoint until the indexer confirms the batch
+func (s *splunkSink) waitForAck(id int64) error {
+	req, err := json.Marshal(map[string][]int64{"acks": {id}})
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.ackWait)
+	for time.Now().Before(deadline) {
+		result := struct {
+			Acks map[string]bool `json:"acks"`
+		}{}
+		if err := s.do(s.ackURL, req, &result); err != nil {
+			return err
+		}
+		if result.Acks[strconv.FormatInt(id, 10)] {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("ack %d not received within %v", id, s.ackWait)
+}
+
+func (s *splunkSink) do(url string, body []byte, out interface{}) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	if s.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Splunk returned %v: %s", resp.Status, respBody)
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// The ack endpoint beside the configured event endpoint, keeping any prefix
+// a proxy adds, e.g. /splunk/services/collector/ack for
+// /splunk/services/collector/event
+func ackPath(path string) string {
+	path = strings.TrimRight(path, "/")
+	if i := strings.LastIndex(path, "/collector"); i >= 0 {
+		return path[:i+len("/collector")] + "/ack"
+	}
+	return path + "/ack"
+}
+
+// HEC channels are identified by a random UUID
+func newChannel() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAckPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/services/collector", "/services/collector/ack"},
+		{"/services/collector/", "/services/collector/ack"},
+		{"/services/collector/event", "/services/collector/ack"},
+		{"/services/collector/event/1.0", "/services/collector/ack"},
+		{"/splunk/services/collector/raw", "/splunk/services/collector/ack"},
+		{"/hec", "/hec/ack"},
+	}
+	for _, tt := range tests {
+		if got := ackPath(tt.path); got != tt.want {
+			t.Errorf("ackPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// A HEC endpoint under handler, with the sink configured to use it
+func splunkFixture(t *testing.T, config map[string]interface{}, handler http.HandlerFunc) *splunkSink {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	settings := map[string]interface{}{
+		"splunk.server":             strings.TrimPrefix(srv.URL, "https://"),
+		"splunk.insecureSkipVerify": true,
+	}
+	for k, v := range config {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range settings {
+			viper.Set(k, nil)
+		}
+	})
+	s, err := newSplunkSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSplunkAck(t *testing.T) {
+	var mu sync.Mutex
+	paths := []string{}
+	s := splunkFixture(t, map[string]interface{}{"splunk.path": "/proxy/services/collector/event", "splunk.ack": true}, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/ack") {
+			w.Write([]byte(`{"acks": {"7": true}}`))
+			return
+		}
+		w.Write([]byte(`{"text": "Success", "code": 0, "ackId": 7}`))
+	})
+
+	s.Send(Event{Time: time.Now(), Action: "connect", Result: "allowed"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/proxy/services/collector/event", "/proxy/services/collector/ack"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("requested %v, want %v", paths, want)
+	}
+}
+
+func TestSplunkSendDuringFlush(t *testing.T) {
+	posted := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	s := splunkFixture(t, map[string]interface{}{"splunk.batchSize": 2, "splunk.batchWait": 60}, func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			close(posted)
+			<-release
+		})
+		w.Write([]byte(`{"text": "Success", "code": 0}`))
+	})
+	defer close(release)
+	event := Event{Time: time.Now(), Action: "connect", Result: "allowed"}
+
+	// The second event fills the batch, whose POST hangs
+	s.Send(event)
+	go s.Send(event)
+	<-posted
+
+	done := make(chan struct{})
+	go func() {
+		s.Send(event)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send waited for a batch being posted")
+	}
+}
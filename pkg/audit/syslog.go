@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+
+	"github.com/spf13/viper"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// Connects to the local syslog unless audit.syslog.network and address are set
+func newSyslogSink() (*syslogSink, error) {
+	tag := viper.GetString("audit.syslog.tag")
+	if tag == "" {
+		tag = "wireguard-auth"
+	}
+	w, err := syslog.Dial(viper.GetString("audit.syslog.network"), viper.GetString("audit.syslog.address"), syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: w}, nil
+}
+
+func (s *syslogSink) Send(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Result == Denied || e.Result == Failure {
+		return s.writer.Warning(string(b))
+	}
+	return s.writer.Notice(string(b))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
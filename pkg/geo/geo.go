@@ -0,0 +1,109 @@
+package geo
+
+import (
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Where the city database is read from when geoip.cityDB is not set
+const defaultCityDB = "GeoLite2-City.mmdb"
+
+// What is known about a source IP. Found is false when the city database is
+// missing or has no record; ASN is zero when the ASN database is unavailable.
+type Location struct {
+	Found     bool
+	City      string
+	Country   string
+	Latitude  float64
+	Longitude float64
+	ASN       uint
+	ASNOrg    string
+}
+
+// Look up the location and ASN of an IP. Missing databases are logged and
+// leave the corresponding fields empty rather than failing the caller.
+func Lookup(ip net.IP) Location {
+	loc := Location{}
+	if ip == nil {
+		return loc
+	}
+	loc.ASN, loc.ASNOrg, _ = ASN(ip)
+
+	db, err := geoip2.Open(cityDB())
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to open city database, continuing without location")
+		return loc
+	}
+	defer db.Close()
+
+	record, err := db.City(ip)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to locate IP")
+		return loc
+	}
+	loc.Found = record.Country.IsoCode != "" || record.Location.Latitude != 0 || record.Location.Longitude != 0
+	loc.City = record.City.Names["en"]
+	loc.Country = record.Country.IsoCode
+	loc.Latitude = record.Location.Latitude
+	loc.Longitude = record.Location.Longitude
+	return loc
+}
+
+// Report whether the city database can be opened
+func CityAvailable() bool {
+	db, err := geoip2.Open(cityDB())
+	if err != nil {
+		return false
+	}
+	db.Close()
+	return true
+}
+
+func cityDB() string {
+	if path := viper.GetString("geoip.cityDB"); path != "" {
+		return path
+	}
+	return defaultCityDB
+}
+
+// Look up the autonomous system for an IP. Returns false when no ASN
+// database is configured or the IP is unknown.
+func ASN(ip net.IP) (uint, string, bool) {
+	path := viper.GetString("geoip.asnDB")
+	if path == "" || ip == nil {
+		return 0, "", false
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to open ASN database")
+		return 0, "", false
+	}
+	defer db.Close()
+
+	record, err := db.ASN(ip)
+	if err != nil || record.AutonomousSystemNumber == 0 {
+		return 0, "", false
+	}
+	return record.AutonomousSystemNumber, record.AutonomousSystemOrganization, true
+}
+
+// Format an ASN the usual way, e.g. AS13335
+func FormatASN(asn uint) string {
+	return "AS" + strconv.FormatUint(uint64(asn), 10)
+}
+
+// Great-circle distance between two coordinates in kilometres
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,31 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistanceKm(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", 52.52, 13.40, 52.52, 13.40, 0},
+		{"berlin to new york", 52.52, 13.40, 40.71, -74.01, 6385},
+		{"london to paris", 51.51, -0.13, 48.86, 2.35, 343},
+		{"across the date line", 0, 179.5, 0, -179.5, 111},
+		{"pole to pole", 90, 0, -90, 0, 20015},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DistanceKm(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+			if math.Abs(got-tt.want) > 5 {
+				t.Errorf("got %.0fkm, want %.0fkm", got, tt.want)
+			}
+			if back := DistanceKm(tt.lat2, tt.lon2, tt.lat1, tt.lon1); math.Abs(back-got) > 1e-6 {
+				t.Errorf("not symmetric: %v and %v", got, back)
+			}
+		})
+	}
+}
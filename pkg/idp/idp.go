@@ -0,0 +1,54 @@
+package idp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Account states reported by a provider
+const (
+	Active        = "active"
+	Suspended     = "suspended"
+	Deprovisioned = "deprovisioned"
+)
+
+// What the identity provider knows about a user. Accounts that no longer
+// exist are reported as Deprovisioned.
+type Account struct {
+	ID     string
+	Email  string
+	Status string
+	Groups []string
+}
+
+// An identity provider that accounts are reconciled against
+type Provider interface {
+	// Look up an account by email, using the provider's ID when known
+	Lookup(email string, id string) (Account, error)
+}
+
+// The provider set by idp.provider, Okta by default
+func New() (Provider, error) {
+	switch name := strings.ToLower(viper.GetString("idp.provider")); name {
+	case "", "okta":
+		return oktaProvider{}, nil
+	case "scim":
+		return newSCIMProvider(viper.GetString("idp.scim.file"))
+	default:
+		return nil, fmt.Errorf("unknown idp.provider %q", name)
+	}
+}
+
+// Whether the account is in any of the groups, ignoring case
+func (a Account) InAny(groups []string) bool {
+	for _, g := range groups {
+		for _, v := range a.Groups {
+			if strings.EqualFold(g, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package idp
+
+import (
+	"github.com/derrickmartinez/wireguard-auth/pkg/okta"
+)
+
+// Reads account status and groups from the Okta API
+type oktaProvider struct{}
+
+func (oktaProvider) Lookup(email string, id string) (Account, error) {
+	account := Account{ID: id, Email: email, Status: Deprovisioned}
+	status := ""
+	found := false
+	if id != "" {
+		user, ok, err := okta.GetUser(id)
+		if err != nil {
+			return account, err
+		}
+		status, found = user.Status, ok
+	}
+	// No cached ID, or it may be stale because the account was deprovisioned
+	// or deleted and created again. The search skips deprovisioned users, so
+	// finding nobody means the account is gone.
+	if !found || status == "DEPROVISIONED" {
+		userID, userStatus, ok, err := okta.FindUser(email)
+		if err != nil || !ok {
+			return account, err
+		}
+		account.ID, status = userID, userStatus
+	}
+
+	switch status {
+	case "SUSPENDED":
+		account.Status = Suspended
+		return account, nil
+	case "DEPROVISIONED":
+		return account, nil
+	}
+	// Every other status, LOCKED_OUT and PASSWORD_EXPIRED included, is a
+	// user that still belongs to the organization
+	account.Status = Active
+	var err error
+	account.Groups, err = okta.GetUserGroups(account.ID)
+	return account, err
+}
@@ -0,0 +1,76 @@
+package idp
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Reads accounts from a file holding a SCIM ListResponse of User resources,
+// such as an export from another identity provider. Inactive users count as
+// suspended and users missing from the file as deprovisioned.
+type scimProvider struct {
+	byEmail map[string]scimUser
+	byID    map[string]scimUser
+}
+
+type scimListResponse struct {
+	Resources []scimUser `json:"Resources"`
+}
+
+type scimUser struct {
+	ID       string `json:"id"`
+	UserName string `json:"userName"`
+	Active   bool   `json:"active"`
+	Emails   []struct {
+		Value string `json:"value"`
+	} `json:"emails"`
+	Groups []struct {
+		Display string `json:"display"`
+	} `json:"groups"`
+}
+
+func newSCIMProvider(path string) (*scimProvider, error) {
+	if path == "" {
+		return nil, errors.New("idp.scim.file is not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list scimListResponse
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	p := &scimProvider{byEmail: map[string]scimUser{}, byID: map[string]scimUser{}}
+	for _, v := range list.Resources {
+		p.byID[v.ID] = v
+		p.byEmail[strings.ToLower(v.UserName)] = v
+		for _, e := range v.Emails {
+			p.byEmail[strings.ToLower(e.Value)] = v
+		}
+	}
+	return p, nil
+}
+
+func (p *scimProvider) Lookup(email string, id string) (Account, error) {
+	account := Account{ID: id, Email: email, Status: Deprovisioned}
+	user, found := p.byEmail[strings.ToLower(email)]
+	if !found {
+		// IDs cached from Okta won't match, so only fall back to them
+		if user, found = p.byID[id]; !found {
+			return account, nil
+		}
+	}
+	account.ID = user.ID
+	if !user.Active {
+		account.Status = Suspended
+		return account, nil
+	}
+	account.Status = Active
+	for _, g := range user.Groups {
+		account.Groups = append(account.Groups, g.Display)
+	}
+	return account, nil
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "wireguard_auth"
+
+var (
+	Users = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "users",
+		Help:      "Users in the store assigned to a server.",
+	}, []string{"server"})
+	Peers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "peers",
+		Help:      "Peers configured on a server's wireguard interface.",
+	}, []string{"server"})
+	PeersActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "peers_recent_handshake",
+		Help:      "Peers with a handshake inside the handshake window.",
+	}, []string{"server"})
+	PeerReceiveBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "peer_receive_bytes",
+		Help:      "Bytes received from a peer since the interface came up.",
+	}, []string{"server", "profile", "pubkey"})
+	PeerTransmitBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "peer_transmit_bytes",
+		Help:      "Bytes sent to a peer since the interface came up.",
+	}, []string{"server", "profile", "pubkey"})
+	SyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken by one sync iteration.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server"})
+	SyncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_errors_total",
+		Help:      "Sync iterations that failed.",
+	}, []string{"server"})
+	FirewallErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firewall_errors_total",
+		Help:      "Failures applying or clearing a peer's firewall chain.",
+	})
+)
+
+// MFA results happen in separate auth processes, so they are counted in the
+// store and copied here by the sync loop
+var mfaResults = &storeCounters{
+	desc: prometheus.NewDesc(namespace+"_mfa_results_total", "MFA attempts by result, across all gateways.", []string{"result"}, nil),
+}
+
+type storeCounters struct {
+	desc   *prometheus.Desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *storeCounters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *storeCounters) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for label, v := range c.values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, v, label)
+	}
+}
+
+// Replace the MFA result totals read from the store
+func SetMFAResults(values map[string]float64) {
+	mfaResults.mu.Lock()
+	defer mfaResults.mu.Unlock()
+	mfaResults.values = values
+}
+
+func init() {
+	prometheus.MustRegister(Users, Peers, PeersActive, PeerReceiveBytes, PeerTransmitBytes,
+		SyncDuration, SyncErrors, FirewallErrors, mfaResults)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Time a server's sync iteration
+func ObserveSync(server string, start time.Time) {
+	SyncDuration.WithLabelValues(server).Observe(time.Since(start).Seconds())
+}
@@ -1,24 +1,33 @@
 package mfa
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/geo"
 	"github.com/derrickmartinez/wireguard-auth/pkg/okta"
-	"github.com/derrickmartinez/wireguard-auth/pkg/promtail"
+	"github.com/derrickmartinez/wireguard-auth/pkg/policy"
 	"github.com/derrickmartinez/wireguard-auth/pkg/user"
 	"github.com/derrickmartinez/wireguard-auth/pkg/util"
 
-	splunk "github.com/ZachtimusPrime/Go-Splunk-HTTP/splunk/v2"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/oschwald/geoip2-golang"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
+// Results recorded when a connection is refused before any push is sent
+const (
+	policyDenied = "POLICY_DENIED"
+	lockedOut    = "LOCKED_OUT"
+	rateLimited  = "RATE_LIMITED"
+	expired      = "EXPIRED"
+	disabled     = "DISABLED"
+)
+
 func Validate(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
 	// find email from pubkey
 	authUser := user.GetUser(vars.PubKey, svc)
@@ -26,84 +35,169 @@ func Validate(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
 		log.Error().Msg("Unable to locate user's email in table")
 		return false
 	}
-	userIdString := okta.GetUserId(authUser.Email)
-	userFactorId := okta.GetUserPushFactorId(userIdString)
-	userVerfiyURL := viper.GetString("okta.orgUrl") + "/api/v1/users/" + userIdString + "/factors/" + userFactorId + "/verify"
-	verificationStatus := okta.GetVerificationStatus(authUser.Email, userVerfiyURL)
-	log.Info().Msgf("Okta Verify Result for user %s -- %s", authUser.Email, strconv.FormatBool(verificationStatus))
 
-	ip := net.ParseIP(strings.Split(vars.Endpoint, ":")[0])
-	if viper.GetBool("splunk.enabled") {
-		// Set up splunk client
-		splunk := splunk.NewClient(
-			nil,
-			"https://"+viper.GetString("splunk.server")+"/services/collector",
-			viper.GetString("splunk.token"),
-			viper.GetString("splunk.source"),
-			viper.GetString("splunk.sourcetype"),
-			viper.GetString("splunk.index"),
-		)
-		var i interface{}
+	ip := policy.SourceIP(vars.Endpoint)
+	if ip == nil {
+		log.Warn().Msgf("Unable to parse endpoint %q", vars.Endpoint)
+	}
+	location := geo.Lookup(ip)
+	decision := policy.Evaluate(ip, location, user.LastAuth(authUser, svc), time.Now())
+	if decision.Action != policy.Allow {
+		log.Info().Msgf("Policy %v for %v: %v", decision.Action, authUser.Email, decision.Reason)
+	}
 
-		m := map[string]string{"msg": "VPN auth request", "profile": authUser.ProfileName, "email": authUser.Email, "endpoint": vars.Endpoint, "result": strconv.FormatBool(verificationStatus)}
-		i = m
-		err := splunk.Log(i)
-		if err != nil {
-			log.Error().Err(err)
+	factorResult := ""
+	lockedUntil, locked := user.Locked(authUser, svc)
+	switch {
+	case authUser.Disabled():
+		log.Info().Msgf("User %v is disabled", authUser.Email)
+		factorResult = disabled
+	case authUser.Expired(time.Now()):
+		log.Info().Msgf("Access for %v expired at %v", authUser.Email, time.Unix(authUser.ExpiresAt, 0).Format(time.RFC3339))
+		factorResult = expired
+	case locked:
+		log.Info().Msgf("User %v is locked out until %v", authUser.Email, lockedUntil.Format(time.RFC3339))
+		factorResult = lockedOut
+	case decision.Action == policy.Deny:
+		factorResult = policyDenied
+	case decision.Action == policy.Allow && user.InGrace(authUser, ip, svc):
+		log.Info().Msgf("User %v allowed within grace period from %v", authUser.Email, ip)
+		event := authEvent(authUser, vars.Endpoint, ip, location)
+		event.Result = audit.Allowed
+		event.Detail = "GRACE"
+		audit.Emit(event)
+		user.CountResult("grace", svc)
+		return true
+	default:
+		if reason, ok := user.AllowPush(authUser, ip, svc); !ok {
+			log.Warn().Msgf("Rate limit for %v: %v", authUser.Email, reason)
+			factorResult = rateLimited
+			break
+		}
+		stepUp := decision.Action == policy.StepUp
+		if stepUp && !challengeDelivered() {
+			log.Warn().Msgf("No way to send %v the challenge number, sending a plain push", authUser.Email)
+			stepUp = false
+		}
+		pushCtx := okta.PushContext{
+			City:            location.City,
+			Country:         location.Country,
+			ProfileName:     authUser.ProfileName,
+			NumberChallenge: stepUp,
+			OnChallenge: func(correctAnswer int) {
+				showChallenge(authUser, correctAnswer)
+			},
+		}
+		if ip != nil {
+			pushCtx.SourceIP = ip.String()
+		}
+		factorResult = push(&authUser, pushCtx, svc)
+		switch factorResult {
+		case okta.FactorSuccess:
+			user.ClearFailures(authUser, svc)
+		case okta.FactorRejected, okta.FactorTimeout:
+			if user.RecordFailure(authUser, svc) {
+				factorResult = lockedOut
+			}
 		}
 	}
+	verificationStatus := factorResult == okta.FactorSuccess
+	log.Info().Msgf("Okta Verify Result for user %s -- %s (%s)", authUser.Email, strconv.FormatBool(verificationStatus), factorResult)
 
-	db, err := geoip2.Open("GeoLite2-City.mmdb")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to open database!")
+	event := authEvent(authUser, vars.Endpoint, ip, location)
+	event.Detail = factorResult
+	if decision.Action != policy.Allow {
+		event.Reason = "policy " + decision.Action.String() + ": " + decision.Reason
 	}
-	defer db.Close()
-
-	location, err := db.City(ip)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to locate IP")
+	if verificationStatus {
+		event.Result = audit.Allowed
 	}
+	audit.Emit(event)
+	user.CountResult(factorResult, svc)
 
-	if viper.GetBool("loki.enabled") {
-		labels := make(map[string]string)
-		labels["source"] = "wireguard-vpn"
-		labels["job"] = "vpn"
+	if !verificationStatus {
+		log.Info().Msgf("User %v not allowed", authUser.Email)
+		return false
+	}
+	user.Remember(authUser, ip, svc)
+	user.RecordAuth(authUser, location, svc)
+	log.Info().Msgf("User %v allowed", authUser.Email)
+	return true
+}
 
-		cfg := promtail.ClientConfig{
-			PushURL:            viper.GetString("loki.pushURL"),
-			Authorization:      viper.GetString("loki.basicAuth"),
-			Labels:             labels,
-			BatchWait:          1 * time.Second,
-			BatchEntriesNumber: 1000,
-			SendLevel:          promtail.INFO,
-			PrintLevel:         promtail.INFO,
+// Build an auth event, denied until the caller says otherwise
+func authEvent(authUser user.User, endpoint string, ip net.IP, location geo.Location) audit.Event {
+	event := audit.Event{
+		Actor:    authUser.Email,
+		Action:   "auth",
+		Profile:  authUser.ProfileName,
+		Email:    authUser.Email,
+		Result:   audit.Denied,
+		Endpoint: endpoint,
+	}
+	if ip != nil {
+		event.RemoteIP = ip.String()
+	}
+	if location.Found || location.ASN != 0 {
+		event.Geo = &audit.Geo{
+			City:    location.City,
+			Country: location.Country,
+			Lat:     location.Latitude,
+			Lon:     location.Longitude,
+			ASN:     location.ASN,
 		}
-		loki, err := promtail.NewClientJson(cfg)
+	}
+	return event
+}
+
+// Send the push, resolving Okta IDs when they are not cached or turn out stale
+func push(authUser *user.User, pushCtx okta.PushContext, svc *dynamodb.DynamoDB) string {
+	var err error
+	cached := authUser.OktaUserId != "" && authUser.OktaFactorId != ""
+	if !cached {
+		*authUser, err = user.ResolveIdp(*authUser, svc)
 		if err != nil {
-			log.Error().Err(err).Msg("Promtail client error")
+			log.Error().Err(err).Msg("Unable to resolve Okta user")
+			return ""
+		}
+	}
+	factorResult, err := okta.GetVerificationStatus(okta.VerifyURL(authUser.OktaUserId, authUser.OktaFactorId), pushCtx)
+	if errors.Is(err, okta.ErrPushNotSent) && cached {
+		// Cached IDs may be stale after a factor reset; look them up and try once more
+		log.Info().Err(err).Msg("Push failed with cached Okta IDs, refreshing")
+		*authUser, err = user.ResolveIdp(*authUser, svc)
+		if err == nil {
+			factorResult, err = okta.GetVerificationStatus(okta.VerifyURL(authUser.OktaUserId, authUser.OktaFactorId), pushCtx)
 		}
-		defer loki.Shutdown()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Okta push verification failed")
+	}
+	return factorResult
+}
 
-		writer := promtail.CustomWriter{Client: loki}
-		logger := zerolog.New(writer).With().Timestamp().Logger()
-		logger.Info().Str("msg", "VPN auth request").
-			Str("profile", authUser.ProfileName).
-			Str("email", authUser.Email).
-			Str("endpoint", vars.Endpoint).
-			Str("remoteIP", ip.String()).
-			Str("city", location.City.Names["en"]).
-			Float64("lat", location.Location.Latitude).
-			Float64("lon", location.Location.Longitude).
-			Str("county", location.Country.IsoCode).
-			Str("result", strconv.FormatBool(verificationStatus)).
-			Msg("MFA Result")
-		time.Sleep(3 * time.Second)
+// Reject settings that would leave users unable to approve a push. Call once
+// at startup.
+func CheckConfig() error {
+	if viper.GetBool("okta.numberChallenge") && !challengeDelivered() {
+		return errors.New("okta.numberChallenge needs okta.challengeEmail and smtp.enabled to tell users the number")
 	}
+	return nil
+}
 
-	if !verificationStatus {
-		log.Info().Msgf("User %v not allowed", authUser.Email)
-		return false
+// The user never sees the auth process's output, so a number challenge can
+// only be answered when the number is emailed
+func challengeDelivered() bool {
+	return viper.GetBool("okta.challengeEmail") && viper.GetBool("smtp.enabled")
+}
+
+// Tell the user which number to pick in Okta Verify
+func showChallenge(authUser user.User, correctAnswer int) {
+	log.Info().Msgf("Number challenge %d sent for %v", correctAnswer, authUser.Email)
+	if challengeDelivered() {
+		body := fmt.Sprintf("A VPN connection for %v is waiting for approval. Select %d in Okta Verify to approve it.\n\nIf you did not just connect, deny the request.", authUser.ProfileName, correctAnswer)
+		if err := user.SendNotice(authUser, "Wireguard VPN sign-in challenge", body); err != nil {
+			log.Error().Err(err).Msg("Error sending challenge email")
+		}
 	}
-	log.Info().Msgf("User %v allowed", authUser.Email)
-	return true
 }
@@ -1,11 +1,13 @@
 package okta
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/derrickmartinez/wireguard-auth/pkg/structs"
@@ -16,137 +18,270 @@ import (
 	"github.com/spf13/viper"
 )
 
-func GetVerificationStatus(email string, userVerifyURL string) bool {
-	pollingHref := sendPushToUser(userVerifyURL)
-	pushResult := waitForPush(pollingHref)
-	return pushResult
+// Push factor results reported by Okta while a verify transaction is open
+const (
+	FactorWaiting   = "WAITING"
+	FactorSuccess   = "SUCCESS"
+	FactorRejected  = "REJECTED"
+	FactorTimeout   = "TIMEOUT"
+	FactorCancelled = "CANCELLED"
+)
+
+const (
+	defaultPushTimeout  = 60 * time.Second
+	defaultPollInterval = 3 * time.Second
+)
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Returned when the verify call itself fails and no push reached the user,
+// which usually means the cached user or factor ID is stale
+var ErrPushNotSent = errors.New("push not sent")
+
+// Details about the connection being approved. Okta derives the location shown
+// in the push from the forwarded source IP and the client from the user agent.
+type PushContext struct {
+	SourceIP    string
+	City        string
+	Country     string
+	ProfileName string
+	// Require a number challenge even when okta.numberChallenge is off
+	NumberChallenge bool
+	// Called with the number the user must pick when a number challenge is issued
+	OnChallenge func(correctAnswer int)
 }
 
-func GetUserId(email string) string {
-	client, err := okta.NewClient(context.TODO(), okta.WithOrgUrl(viper.GetString("okta.orgUrl")), okta.WithToken(viper.GetString("okta.apikey")))
+// Send a push to the user and wait for a final factorResult
+func GetVerificationStatus(userVerifyURL string, pushCtx PushContext) (string, error) {
+	factor, err := sendPushToUser(userVerifyURL, pushCtx)
 	if err != nil {
-		log.Fatal().Err(err)
+		return "", fmt.Errorf("%w: %v", ErrPushNotSent, err)
 	}
-	filter := query.NewQueryParams(query.WithQ(email))
-	users, resp, err := client.User.ListUsers(filter)
-	_ = resp
+	return waitForPush(factor, pushCtx)
+}
+
+// Look up the Okta user ID and push factor ID for an email address
+func ResolveIds(email string) (string, string, error) {
+	userID, err := GetUserId(email)
+	if err != nil {
+		return "", "", err
+	}
+	factorID, err := GetUserPushFactorId(userID)
 	if err != nil {
-		log.Fatal().Err(err)
+		return "", "", err
 	}
+	return userID, factorID, nil
+}
 
-	return users[0].Id
+// Build the verify URL for a user's push factor
+func VerifyURL(userID string, factorID string) string {
+	return viper.GetString("okta.orgUrl") + "/api/v1/users/" + userID + "/factors/" + factorID + "/verify"
 }
 
-func GetUserPushFactorId(userID string) string {
-	data := structs.VerifyPayload{}
-	payloadBytes, err := json.Marshal(data)
+func GetUserId(email string) (string, error) {
+	user, err := searchUser(email)
 	if err != nil {
-		log.Fatal().Err(err)
+		return "", err
 	}
-	body := bytes.NewReader(payloadBytes)
-	req, err := http.NewRequest("GET", viper.GetString("okta.orgUrl")+"/api/v1/users/"+userID+"/factors", body)
-	if err != nil {
-		log.Fatal().Err(err)
+	if user == nil {
+		return "", errors.New("No Okta user found for " + email)
 	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	authHeaderValue := "SSWS " + viper.GetString("okta.apikey")
-	req.Header.Set("Authorization", authHeaderValue)
+	return user.Id, nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// Search for the Okta user whose email or login is exactly email, ignoring
+// case. Nil when nobody matches; the search also matches prefixes of other
+// fields, and deprovisioned users are not searched.
+func searchUser(email string) (*okta.User, error) {
+	client, err := okta.NewClient(context.TODO(), okta.WithOrgUrl(viper.GetString("okta.orgUrl")), okta.WithToken(viper.GetString("okta.apikey")))
 	if err != nil {
-		log.Fatal().Err(err)
+		return nil, err
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
+	filter := query.NewQueryParams(query.WithQ(email))
+	users, _, err := client.User.ListUsers(filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range users {
+		if v.Profile == nil {
+			continue
+		}
+		for _, attr := range []string{"email", "login"} {
+			if s, ok := (*v.Profile)[attr].(string); ok && strings.EqualFold(s, email) {
+				return v, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func GetUserPushFactorId(userID string) (string, error) {
+	respBody, err := oktaRequest("GET", viper.GetString("okta.orgUrl")+"/api/v1/users/"+userID+"/factors", nil)
 	if err != nil {
-		log.Fatal().Err(err)
+		return "", err
 	}
 	var result structs.UserFactorResponse
-	if err := json.Unmarshal(respBody, &result); err != nil { // Parse []byte to go struct pointer
-		_ = err
-		log.Fatal().Err(err)
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 	for _, v := range result {
 		if v.FactorType == "push" {
-			factorID := v.ID
-			return factorID
+			return v.ID, nil
 		}
 	}
-	return ""
+	return "", errors.New("No push factor enrolled for Okta user " + userID)
 }
 
-func sendPushToUser(userVerifyURL string) string {
-	req, err := http.NewRequest("POST", userVerifyURL, nil)
-	if err != nil {
-		log.Fatal().Err(err)
-		// handle err
+func sendPushToUser(userVerifyURL string, pushCtx PushContext) (structs.WaitingFactor, error) {
+	var result structs.WaitingFactor
+	if viper.GetBool("okta.numberChallenge") || pushCtx.NumberChallenge {
+		userVerifyURL += "?useNumberMatchingChallenge=true"
 	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	authHeaderValue := "SSWS " + viper.GetString("okta.apikey")
-	req.Header.Set("Authorization", authHeaderValue)
+	header := http.Header{}
+	if pushCtx.SourceIP != "" {
+		header.Set("X-Forwarded-For", pushCtx.SourceIP)
+	}
+	header.Set("User-Agent", pushUserAgent(pushCtx))
 
-	resp, err := http.DefaultClient.Do(req)
+	respBody, err := oktaRequest("POST", userVerifyURL, header)
 	if err != nil {
-		log.Fatal().Err(err)
-		// handle err
+		return result, err
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
-	_ = err
-	defer resp.Body.Close()
-	var result structs.WaitingFactor
-	// var result structs.VerifyResponse
-	if err := json.Unmarshal(respBody, &result); err != nil { // Parse []byte to go struct pointer
-		log.Fatal().Err(err)
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return result, err
 	}
-	b, err := json.MarshalIndent(result, "", "  ")
-	if err != nil {
-		log.Fatal().Err(err)
+	if result.FactorResult == "" {
+		return result, errors.New("Okta verify response has no factorResult: " + string(respBody))
 	}
-	_ = b
-	pollURL := result.Links.Poll.Href
-	waitingForPush(pollURL)
-	return pollURL
+	return result, nil
 }
 
-func waitForPush(verifyHref string) bool {
-	for i := 0; i < 3; i++ {
-		verified := waitingForPush(verifyHref)
-		if verified.FactorResult == "SUCCESS" {
-			return true
-		} else {
-			log.Info().Msg("waiting for 5 seconds and checking for push verification again")
-			verified = waitingForPush(verifyHref)
-			time.Sleep(time.Second * 5)
+// Describe the connection in the user agent so it shows up on the device
+func pushUserAgent(pushCtx PushContext) string {
+	details := []string{}
+	if pushCtx.ProfileName != "" {
+		details = append(details, "profile "+pushCtx.ProfileName)
+	}
+	if pushCtx.City != "" {
+		details = append(details, pushCtx.City)
+	}
+	if pushCtx.Country != "" {
+		details = append(details, pushCtx.Country)
+	}
+	if len(details) == 0 {
+		return "wireguard-auth"
+	}
+	return "wireguard-auth (" + strings.Join(details, ", ") + ")"
+}
+
+// Poll the push transaction until it leaves WAITING or the deadline passes
+func waitForPush(factor structs.WaitingFactor, pushCtx PushContext) (string, error) {
+	timeout := time.Second * time.Duration(viper.GetInt("okta.pushTimeout"))
+	if timeout <= 0 {
+		timeout = defaultPushTimeout
+	}
+	interval := time.Second * time.Duration(viper.GetInt("okta.pollInterval"))
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	deadline := time.Now().Add(timeout)
+	challenged := false
+
+	for {
+		if answer := factor.Embedded.Challenge.CorrectAnswer; answer != 0 && !challenged {
+			challenged = true
+			if pushCtx.OnChallenge != nil {
+				pushCtx.OnChallenge(answer)
+			}
+		}
+
+		switch factor.FactorResult {
+		case FactorSuccess:
+			return FactorSuccess, nil
+		case FactorRejected, FactorTimeout, FactorCancelled:
+			log.Info().Msgf("Push verification finished with %v", factor.FactorResult)
+			return factor.FactorResult, nil
+		case FactorWaiting:
+		default:
+			return factor.FactorResult, errors.New("unexpected factorResult " + factor.FactorResult)
+		}
+
+		// Okta returns a fresh poll link with every response
+		pollURL := factor.Links.Poll.Href
+		if pollURL == "" {
+			return factor.FactorResult, errors.New("Okta response is missing the poll link")
+		}
+		if time.Now().Add(interval).After(deadline) {
+			log.Info().Msgf("No push response after %v, cancelling", timeout)
+			cancelPush(factor)
+			return FactorTimeout, nil
+		}
+		time.Sleep(interval)
+
+		next, err := waitingForPush(pollURL)
+		if err != nil {
+			cancelPush(factor)
+			return factor.FactorResult, err
+		}
+		// The poll response drops the cancel link once the transaction is finished
+		if next.Links.Cancel.Href == "" {
+			next.Links.Cancel = factor.Links.Cancel
 		}
+		factor = next
 	}
-	return false
 }
 
-func waitingForPush(pollURL string) structs.WaitingFactor {
-	req, err := http.NewRequest("GET", pollURL, nil)
+func waitingForPush(pollURL string) (structs.WaitingFactor, error) {
+	var result structs.WaitingFactor
+	respBody, err := oktaRequest("GET", pollURL, nil)
+	if err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Cancel an outstanding push so it can no longer be approved on the device
+func cancelPush(factor structs.WaitingFactor) {
+	cancelURL := factor.Links.Cancel.Href
+	if cancelURL == "" {
+		return
+	}
+	method := "DELETE"
+	if len(factor.Links.Cancel.Hints.Allow) > 0 {
+		method = factor.Links.Cancel.Hints.Allow[0]
+	}
+	if _, err := oktaRequest(method, cancelURL, nil); err != nil {
+		log.Error().Err(err).Msg("Unable to cancel push transaction")
+	}
+}
+
+// Send an authenticated request to the Okta API and return the response body
+func oktaRequest(method string, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		log.Fatal().Err(err)
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "SSWS "+viper.GetString("okta.apikey"))
-	resp, err := http.DefaultClient.Do(req)
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Fatal().Err(err)
+		return nil, err
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
-	_ = err
 	defer resp.Body.Close()
-	var result structs.WaitingFactor
-	if err := json.Unmarshal(respBody, &result); err != nil { // Parse []byte to go struct pointer
-		log.Fatal().Err(err)
-	}
-	b, err := json.MarshalIndent(result, "", "  ")
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal().Err(err)
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return respBody, &APIError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
 	}
-	_ = b
-	return result
+	return respBody, nil
 }
@@ -0,0 +1,185 @@
+package okta
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// An Okta org served by handler. The SDK client uses the default transport,
+// so it is pointed at the test server's certificate for the test.
+func oktaFixture(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	transport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	client := httpClient
+	httpClient = srv.Client()
+	viper.Set("okta.orgUrl", srv.URL)
+	viper.Set("okta.apikey", "token")
+	t.Cleanup(func() {
+		srv.Close()
+		http.DefaultTransport = transport
+		httpClient = client
+		viper.Set("okta.orgUrl", nil)
+		viper.Set("okta.apikey", nil)
+	})
+	return srv
+}
+
+func TestSearchUser(t *testing.T) {
+	// The search matches prefixes of names and emails as well
+	oktaFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("q") {
+		case "bob@example.com":
+			w.Write([]byte(`[
+				{"id": "00ubobby", "status": "ACTIVE", "profile": {"email": "bob@example.com.au", "login": "bobby"}},
+				{"id": "00ubob", "status": "SUSPENDED", "profile": {"email": "robert@example.com", "login": "Bob@Example.com"}}
+			]`))
+		case "carol@example.com":
+			w.Write([]byte(`[{"id": "00ucaroline", "status": "ACTIVE", "profile": {"email": "carol@example.community", "login": "caroline"}}]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	})
+
+	tests := []struct {
+		email  string
+		id     string
+		status string
+		found  bool
+	}{
+		{"bob@example.com", "00ubob", "SUSPENDED", true},
+		{"carol@example.com", "", "", false},
+		{"dave@example.com", "", "", false},
+	}
+	for _, tt := range tests {
+		id, status, found, err := FindUser(tt.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != tt.id || status != tt.status || found != tt.found {
+			t.Errorf("FindUser(%v) = %v, %v, %v, want %v, %v, %v", tt.email, id, status, found, tt.id, tt.status, tt.found)
+		}
+	}
+	if _, err := GetUserId("carol@example.com"); err == nil {
+		t.Error("GetUserId resolved an account that only partly matches")
+	}
+}
+
+// A push transaction per path prefix: verify starts it WAITING, the first
+// poll link leads to a second one, and the second poll returns the result
+// named by the prefix
+func pushServer(t *testing.T) (*httptest.Server, func(scenario string) []string) {
+	var mu sync.Mutex
+	requests := map[string][]string{}
+	var srv *httptest.Server
+	srv = oktaFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		scenario, step := parts[0], parts[1]
+		mu.Lock()
+		requests[scenario] = append(requests[scenario], r.Method+" "+step)
+		mu.Unlock()
+
+		links := func(poll string) string {
+			if poll != "" {
+				poll = fmt.Sprintf(`"poll": {"href": "%v/%v/%v"},`, srv.URL, scenario, poll)
+			}
+			return fmt.Sprintf(`"_links": {%v "cancel": {"href": "%v/%v/cancel", "hints": {"allow": ["DELETE"]}}}`, poll, srv.URL, scenario)
+		}
+		switch step {
+		case "verify":
+			if scenario == "nopoll" {
+				fmt.Fprintf(w, `{"factorResult": "WAITING", %v}`, links(""))
+				return
+			}
+			fmt.Fprintf(w, `{"factorResult": "WAITING", "_embedded": {"challenge": {"correctAnswer": 42}}, %v}`, links("poll-1"))
+		case "poll-1":
+			fmt.Fprintf(w, `{"factorResult": "WAITING", %v}`, links("poll-2"))
+		case "poll-2":
+			fmt.Fprintf(w, `{"factorResult": %q, "_links": {}}`, strings.ToUpper(scenario))
+		case "cancel":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	return srv, func(scenario string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[scenario]
+	}
+}
+
+func TestGetVerificationStatus(t *testing.T) {
+	srv, requests := pushServer(t)
+	viper.Set("okta.pollInterval", 1)
+	viper.Set("okta.pushTimeout", 30)
+	t.Cleanup(func() {
+		viper.Set("okta.pollInterval", nil)
+		viper.Set("okta.pushTimeout", nil)
+	})
+
+	tests := []struct {
+		scenario string
+		want     string
+	}{
+		{"success", FactorSuccess},
+		{"rejected", FactorRejected},
+		{"timeout", FactorTimeout},
+		{"cancelled", FactorCancelled},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.scenario, func(t *testing.T) {
+			t.Parallel()
+			challenges := []int{}
+			result, err := GetVerificationStatus(srv.URL+"/"+tt.scenario+"/verify", PushContext{
+				OnChallenge: func(answer int) { challenges = append(challenges, answer) },
+			})
+			if err != nil || result != tt.want {
+				t.Fatalf("got %v, %v, want %v", result, err, tt.want)
+			}
+			// Both poll links were followed and the finished push not cancelled
+			want := "POST verify, GET poll-1, GET poll-2"
+			if got := strings.Join(requests(tt.scenario), ", "); got != want {
+				t.Errorf("requests %v, want %v", got, want)
+			}
+			if len(challenges) != 1 || challenges[0] != 42 {
+				t.Errorf("challenge reported as %v, want once with 42", challenges)
+			}
+		})
+	}
+}
+
+func TestGetVerificationStatusDeadline(t *testing.T) {
+	srv, requests := pushServer(t)
+	// The first wait would pass the deadline
+	viper.Set("okta.pollInterval", 5)
+	viper.Set("okta.pushTimeout", 1)
+	t.Cleanup(func() {
+		viper.Set("okta.pollInterval", nil)
+		viper.Set("okta.pushTimeout", nil)
+	})
+
+	result, err := GetVerificationStatus(srv.URL+"/success/verify", PushContext{})
+	if err != nil || result != FactorTimeout {
+		t.Fatalf("got %v, %v, want %v", result, err, FactorTimeout)
+	}
+	if got := strings.Join(requests("success"), ", "); got != "POST verify, DELETE cancel" {
+		t.Errorf("requests %v, want the push cancelled", got)
+	}
+
+	if _, err := GetVerificationStatus(srv.URL+"/nopoll/verify", PushContext{}); err == nil {
+		t.Error("waited without a poll link")
+	}
+	if _, err := GetVerificationStatus(srv.URL+"/missing/nothing", PushContext{}); !errors.Is(err, ErrPushNotSent) {
+		t.Errorf("got %v, want ErrPushNotSent", err)
+	}
+}
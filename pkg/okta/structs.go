@@ -148,7 +148,7 @@ type OktaResponseFull struct {
 				AppID             interface{} `json:"appId"`
 				Version           interface{} `json:"version"`
 				AuthenticatorName string      `json:"authenticatorName"`
-			} `json:"profile,omitempty"`
+			} `json:"-"`
 		} `json:"factors"`
 		Policy struct {
 			AllowRememberDevice             bool `json:"allowRememberDevice"`
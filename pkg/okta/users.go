@@ -0,0 +1,69 @@
+package okta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/structs"
+
+	"github.com/spf13/viper"
+)
+
+// Names of the groups an Okta user belongs to
+func GetUserGroups(userID string) ([]string, error) {
+	respBody, err := oktaRequest("GET", viper.GetString("okta.orgUrl")+"/api/v1/users/"+userID+"/groups", nil)
+	if err != nil {
+		return nil, err
+	}
+	var result structs.UserGroupsResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, v := range result {
+		groups = append(groups, v.Profile.Name)
+	}
+	return groups, nil
+}
+
+// An error response from the Okta API
+type APIError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Okta returned %v: %s", e.Status, e.Body)
+}
+
+// Get an Okta user by ID. Deprovisioned users are returned too; found is
+// false once the user has been deleted.
+func GetUser(userID string) (UserDataResponse, bool, error) {
+	var result UserDataResponse
+	respBody, err := oktaRequest("GET", viper.GetString("okta.orgUrl")+"/api/v1/users/"+url.PathEscape(userID), nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return result, false, nil
+	}
+	if err != nil {
+		return result, false, err
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return result, false, err
+	}
+	return result, true, nil
+}
+
+// Find the Okta user for an email the way GetUserId does and return its ID
+// and status. Found is false when the search finds nobody.
+func FindUser(email string) (string, string, bool, error) {
+	user, err := searchUser(email)
+	if err != nil || user == nil {
+		return "", "", false, err
+	}
+	return user.Id, user.Status, true, nil
+}
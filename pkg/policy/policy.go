@@ -0,0 +1,214 @@
+package policy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/geo"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	// Always push, ignoring the grace window, and require a number challenge
+	StepUp
+	Deny
+)
+
+func (a Action) String() string {
+	switch a {
+	case StepUp:
+		return "stepup"
+	case Deny:
+		return "deny"
+	}
+	return "allow"
+}
+
+// Parse an action from config, falling back to def for empty or unknown values
+func ParseAction(s string, def Action) Action {
+	switch strings.ToLower(strings.Replace(s, "-", "", -1)) {
+	case "allow":
+		return Allow
+	case "stepup":
+		return StepUp
+	case "deny":
+		return Deny
+	case "":
+		return def
+	}
+	log.Warn().Msgf("Unknown policy action %q, using %v", s, def)
+	return def
+}
+
+type Decision struct {
+	Action Action
+	Reason string
+}
+
+// The last successful authentication, used for impossible travel checks
+type PreviousAuth struct {
+	Latitude  float64
+	Longitude float64
+	Time      time.Time
+}
+
+// The source IP of a wireguard endpoint such as 198.51.100.7:51820 or
+// [2001:db8::1]:51820, nil when it can't be parsed
+func SourceIP(endpoint string) net.IP {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		// No port
+		host = strings.Trim(endpoint, "[]")
+	}
+	return net.ParseIP(host)
+}
+
+// Evaluate the configured policy for a connection. The strictest matching
+// rule wins; a trusted CIDR skips the location checks altogether.
+func Evaluate(ip net.IP, loc geo.Location, prev *PreviousAuth, now time.Time) Decision {
+	// Without a source none of the network rules can be checked
+	if ip == nil {
+		return Decision{ParseAction(viper.GetString("policy.unknownSource"), Deny), "unparseable endpoint"}
+	}
+
+	if cidr, ok := matchCIDR(ip, viper.GetStringSlice("policy.cidrs.deny")); ok {
+		return Decision{Deny, "source in denied network " + cidr}
+	}
+	if cidr, ok := matchCIDR(ip, viper.GetStringSlice("policy.cidrs.allow")); ok {
+		return Decision{Allow, "source in trusted network " + cidr}
+	}
+
+	decision := Decision{Allow, ""}
+	raise := func(a Action, reason string) {
+		if a > decision.Action {
+			decision = Decision{a, reason}
+		}
+	}
+
+	if loc.ASN != 0 {
+		asn := geo.FormatASN(loc.ASN)
+		if matchASN(loc.ASN, viper.GetStringSlice("policy.asns.deny")) {
+			raise(Deny, "denied network "+asn)
+		}
+		if matchASN(loc.ASN, viper.GetStringSlice("policy.asns.stepUp")) {
+			raise(StepUp, "step-up network "+asn)
+		}
+	}
+
+	if !loc.Found {
+		raise(unknownLocation(), "location unknown")
+		return decision
+	}
+
+	if matchCountry(loc.Country, viper.GetStringSlice("policy.countries.deny")) {
+		raise(Deny, "denied country "+loc.Country)
+	}
+	if allow := viper.GetStringSlice("policy.countries.allow"); len(allow) > 0 && !matchCountry(loc.Country, allow) {
+		raise(Deny, "country "+loc.Country+" not allowed")
+	}
+	if matchCountry(loc.Country, viper.GetStringSlice("policy.countries.stepUp")) {
+		raise(StepUp, "step-up country "+loc.Country)
+	}
+
+	if prev != nil && viper.GetBool("policy.impossibleTravel.enabled") {
+		if reason, ok := impossibleTravel(loc, *prev, now); ok {
+			raise(ParseAction(viper.GetString("policy.impossibleTravel.action"), StepUp), reason)
+		}
+	}
+
+	return decision
+}
+
+// The action for a source that can't be located. With a country allow list
+// an unknown location can't be shown to be allowed, so it is denied unless
+// policy.unknownLocation says otherwise.
+func unknownLocation() Action {
+	def := Allow
+	if len(viper.GetStringSlice("policy.countries.allow")) > 0 {
+		def = Deny
+	}
+	return ParseAction(viper.GetString("policy.unknownLocation"), def)
+}
+
+// Warn about settings that leave the country allow list unenforced. Call once
+// at startup.
+func CheckConfig() {
+	if len(viper.GetStringSlice("policy.countries.allow")) == 0 {
+		return
+	}
+	if !geo.CityAvailable() {
+		log.Warn().Msgf("policy.countries.allow is set but the city database can't be opened, every connection gets policy.unknownLocation (%v)", unknownLocation())
+	}
+	if unknownLocation() == Allow {
+		log.Warn().Msg("policy.unknownLocation is allow, connections that can't be located bypass policy.countries.allow")
+	}
+}
+
+// Flag travel faster than policy.impossibleTravel.maxSpeedKmh (default 1000).
+// Short hops are ignored since geolocation is only accurate to a region.
+func impossibleTravel(loc geo.Location, prev PreviousAuth, now time.Time) (string, bool) {
+	maxSpeed := viper.GetFloat64("policy.impossibleTravel.maxSpeedKmh")
+	if maxSpeed <= 0 {
+		maxSpeed = 1000
+	}
+	minDistance := viper.GetFloat64("policy.impossibleTravel.minDistanceKm")
+	if minDistance <= 0 {
+		minDistance = 500
+	}
+
+	distance := geo.DistanceKm(prev.Latitude, prev.Longitude, loc.Latitude, loc.Longitude)
+	if distance < minDistance {
+		return "", false
+	}
+	hours := now.Sub(prev.Time).Hours()
+	if hours > 0 && distance/hours <= maxSpeed {
+		return "", false
+	}
+	return "impossible travel of " + strconv.Itoa(int(distance)) + "km since " + prev.Time.Format(time.RFC3339), true
+}
+
+func matchCIDR(ip net.IP, cidrs []string) (string, bool) {
+	for _, v := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			log.Warn().Err(err).Msg("Invalid CIDR in policy")
+			continue
+		}
+		if network.Contains(ip) {
+			return network.String(), true
+		}
+	}
+	return "", false
+}
+
+func matchCountry(country string, countries []string) bool {
+	for _, v := range countries {
+		if strings.EqualFold(strings.TrimSpace(v), country) {
+			return true
+		}
+	}
+	return false
+}
+
+// ASNs may be written as 13335 or AS13335
+func matchASN(asn uint, asns []string) bool {
+	for _, v := range asns {
+		v = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "AS")
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			log.Warn().Msgf("Invalid ASN %q in policy", v)
+			continue
+		}
+		if uint(n) == asn {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/geo"
+
+	"github.com/spf13/viper"
+)
+
+func withConfig(t *testing.T, config map[string]interface{}) {
+	t.Helper()
+	viper.Reset()
+	for k, v := range config {
+		viper.Set(k, v)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+func TestSourceIP(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"198.51.100.7:51820", "198.51.100.7"},
+		{"[2001:db8::1]:51820", "2001:db8::1"},
+		{"198.51.100.7", "198.51.100.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"", ""},
+		{"not-an-ip:51820", ""},
+	}
+	for _, tt := range tests {
+		got := SourceIP(tt.endpoint)
+		if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("SourceIP(%q) = %v, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	berlin := geo.Location{Found: true, Country: "DE", Latitude: 52.52, Longitude: 13.40}
+	newYork := geo.Location{Found: true, Country: "US", Latitude: 40.71, Longitude: -74.01, ASN: 64500}
+	fromBerlin := &PreviousAuth{Latitude: berlin.Latitude, Longitude: berlin.Longitude, Time: now.Add(-time.Hour)}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		ip     string
+		loc    geo.Location
+		prev   *PreviousAuth
+		want   Action
+	}{
+		{"no rules", nil, "198.51.100.7", newYork, nil, Allow},
+		{"unparseable endpoint denies by default", nil, "", newYork, nil, Deny},
+		{"unparseable endpoint follows policy", map[string]interface{}{"policy.unknownSource": "stepup"}, "", newYork, nil, StepUp},
+		{"denied cidr", map[string]interface{}{"policy.cidrs.deny": []string{"198.51.100.0/24"}}, "198.51.100.7", newYork, nil, Deny},
+		{"denied ipv6 cidr", map[string]interface{}{"policy.cidrs.deny": []string{"2001:db8::/32"}}, "2001:db8::1", newYork, nil, Deny},
+		{"trusted cidr skips location", map[string]interface{}{"policy.cidrs.allow": []string{"198.51.100.0/24"}, "policy.countries.deny": []string{"US"}}, "198.51.100.7", newYork, nil, Allow},
+		{"deny wins over trust", map[string]interface{}{"policy.cidrs.allow": []string{"198.51.100.0/24"}, "policy.cidrs.deny": []string{"198.51.100.7/32"}}, "198.51.100.7", newYork, nil, Deny},
+		{"denied asn", map[string]interface{}{"policy.asns.deny": []string{"AS64500"}}, "198.51.100.7", newYork, nil, Deny},
+		{"step-up asn", map[string]interface{}{"policy.asns.stepUp": []string{"64500"}}, "198.51.100.7", newYork, nil, StepUp},
+		{"denied country", map[string]interface{}{"policy.countries.deny": []string{"us"}}, "198.51.100.7", newYork, nil, Deny},
+		{"country not allowed", map[string]interface{}{"policy.countries.allow": []string{"DE"}}, "198.51.100.7", newYork, nil, Deny},
+		{"allowed country", map[string]interface{}{"policy.countries.allow": []string{"DE"}}, "198.51.100.7", berlin, nil, Allow},
+		{"step-up country", map[string]interface{}{"policy.countries.stepUp": []string{"US"}}, "198.51.100.7", newYork, nil, StepUp},
+		{"strictest rule wins", map[string]interface{}{"policy.countries.stepUp": []string{"US"}, "policy.asns.deny": []string{"64500"}}, "198.51.100.7", newYork, nil, Deny},
+		{"unknown location", map[string]interface{}{"policy.unknownLocation": "deny"}, "198.51.100.7", geo.Location{}, nil, Deny},
+		{"unknown location allowed by default", nil, "198.51.100.7", geo.Location{}, nil, Allow},
+		{"unknown location with a country allow list", map[string]interface{}{"policy.countries.allow": []string{"DE"}}, "198.51.100.7", geo.Location{}, nil, Deny},
+		{"unknown location with a country allow list follows policy", map[string]interface{}{"policy.countries.allow": []string{"DE"}, "policy.unknownLocation": "stepup"}, "198.51.100.7", geo.Location{}, nil, StepUp},
+		{"impossible travel", map[string]interface{}{"policy.impossibleTravel.enabled": true}, "198.51.100.7", newYork, fromBerlin, StepUp},
+		{"impossible travel action", map[string]interface{}{"policy.impossibleTravel.enabled": true, "policy.impossibleTravel.action": "deny"}, "198.51.100.7", newYork, fromBerlin, Deny},
+		{"impossible travel disabled", nil, "198.51.100.7", newYork, fromBerlin, Allow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.config)
+			got := Evaluate(net.ParseIP(tt.ip), tt.loc, tt.prev, now)
+			if got.Action != tt.want {
+				t.Errorf("got %v (%v), want %v", got.Action, got.Reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestImpossibleTravel(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	berlin := geo.Location{Found: true, Latitude: 52.52, Longitude: 13.40}
+	hamburg := PreviousAuth{Latitude: 53.55, Longitude: 9.99}
+	newYork := PreviousAuth{Latitude: 40.71, Longitude: -74.01}
+	at := func(p PreviousAuth, ago time.Duration) PreviousAuth {
+		p.Time = now.Add(-ago)
+		return p
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		prev   PreviousAuth
+		want   bool
+	}{
+		{"short hop", nil, at(hamburg, time.Minute), false},
+		{"flight time", nil, at(newYork, 10*time.Hour), false},
+		{"too fast", nil, at(newYork, time.Hour), true},
+		{"same instant", nil, at(newYork, 0), true},
+		{"faster limit", map[string]interface{}{"policy.impossibleTravel.maxSpeedKmh": 10000}, at(newYork, time.Hour), false},
+		{"shorter minimum", map[string]interface{}{"policy.impossibleTravel.minDistanceKm": 100}, at(hamburg, time.Minute), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.config)
+			if _, got := impossibleTravel(berlin, tt.prev, now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
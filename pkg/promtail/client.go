@@ -0,0 +1,289 @@
+package promtail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type logEntry struct {
+	ts    time.Time
+	line  string
+	level LogLevel
+	// Extra labels for this entry, added to ClientConfig.Labels
+	labels map[string]string
+}
+
+type client struct {
+	config    *ClientConfig
+	quit      chan struct{}
+	entries   chan *logEntry
+	waitGroup sync.WaitGroup
+	client    httpClient
+	spool     *spool
+	encoder   encoder
+	// Set by Shutdown before quit is closed
+	deadline time.Time
+	// Cancelled at the shutdown deadline, aborting requests in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Create a client pushing in the format selected by conf.Format
+func NewClient(conf ClientConfig) (Client, error) {
+	conf.setDefaults()
+	c := client{
+		config:  &conf,
+		quit:    make(chan struct{}),
+		entries: make(chan *logEntry, LOG_ENTRIES_CHAN_SIZE),
+		client:  httpClient{parent: http.Client{Timeout: 10 * time.Second}},
+		spool:   newSpool(conf.SpoolDir, conf.SpoolMaxBytes),
+		encoder: encoderFor(conf.Format),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	c.waitGroup.Add(1)
+	go c.run()
+
+	return &c, nil
+}
+
+func NewClientJson(conf ClientConfig) (Client, error) {
+	conf.Format = JSON
+	return NewClient(conf)
+}
+
+// Push with protobuf and snappy to Loki's native endpoint
+func NewClientProto(conf ClientConfig) (Client, error) {
+	conf.Format = Protobuf
+	return NewClient(conf)
+}
+
+// Log a line already formatted by zerolog, keeping its level
+func (c *client) ZerologWrite(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	c.Log(parseZerologLevel([]byte(line)), nil, strings.TrimRight(line, "\n"))
+}
+
+func (c *client) Debugf(format string, args ...interface{}) {
+	c.log(format, DEBUG, args...)
+}
+
+func (c *client) Infof(format string, args ...interface{}) {
+	c.log(format, INFO, args...)
+}
+
+func (c *client) Warnf(format string, args ...interface{}) {
+	c.log(format, WARN, args...)
+}
+
+func (c *client) Errorf(format string, args ...interface{}) {
+	c.log(format, ERROR, args...)
+}
+
+func (c *client) Log(level LogLevel, labels map[string]string, line string) {
+	if (level >= c.config.SendLevel) || (level >= c.config.PrintLevel) {
+		c.entries <- &logEntry{
+			ts:     time.Now(),
+			line:   line,
+			level:  level,
+			labels: labels,
+		}
+	}
+}
+
+// Format the message as a JSON line with the same fields zerolog uses
+func (c *client) log(format string, level LogLevel, args ...interface{}) {
+	line, err := json.Marshal(struct {
+		Level   string `json:"level"`
+		Time    string `json:"time"`
+		Message string `json:"message"`
+	}{level.String(), time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...)})
+	if err != nil {
+		return
+	}
+	c.Log(level, nil, string(line))
+}
+
+// Flush queued entries, giving up after ShutdownTimeout. Whatever could not
+// be delivered by then is spooled.
+func (c *client) Shutdown() {
+	c.deadline = time.Now().Add(c.config.ShutdownTimeout)
+	timer := time.AfterFunc(c.config.ShutdownTimeout, c.cancel)
+	close(c.quit)
+	c.waitGroup.Wait()
+	timer.Stop()
+	c.cancel()
+}
+
+func (c *client) run() {
+	// Loki rejects entries older than the newest one in a stream, so spooled
+	// batches have to go out before anything logged by this run. Entries
+	// queue up in the channel meanwhile.
+	c.replay()
+
+	var batch []*logEntry
+	batchSize := 0
+	maxWait := time.NewTimer(c.config.BatchWait)
+
+	defer func() {
+		// Pick up anything logged right before Shutdown
+		for drained := false; !drained; {
+			select {
+			case entry := <-c.entries:
+				if c.accept(entry) {
+					batch = append(batch, entry)
+					batchSize++
+				}
+			default:
+				drained = true
+			}
+		}
+		if batchSize > 0 {
+			c.send(batch)
+		}
+
+		c.waitGroup.Done()
+	}()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case entry := <-c.entries:
+			if c.accept(entry) {
+				batch = append(batch, entry)
+				batchSize++
+				if batchSize >= c.config.BatchEntriesNumber {
+					c.send(batch)
+					batch = []*logEntry{}
+					batchSize = 0
+					maxWait.Reset(c.config.BatchWait)
+				}
+			}
+		case <-maxWait.C:
+			if batchSize > 0 {
+				c.send(batch)
+				batch = []*logEntry{}
+				batchSize = 0
+			}
+			maxWait.Reset(c.config.BatchWait)
+		}
+	}
+}
+
+// Print the entry if needed and report whether it should be sent
+func (c *client) accept(entry *logEntry) bool {
+	if entry.level >= c.config.PrintLevel {
+		log.Print(entry.line)
+	}
+	return entry.level >= c.config.SendLevel
+}
+
+func (c *client) send(entries []*logEntry) {
+	body, err := c.encoder.encode(groupStreams(c.config.Labels, entries))
+	if err != nil {
+		log.Printf("promtail.Client: unable to encode a push request: %s\n", err)
+		return
+	}
+	if !c.push(c.encoder, body) {
+		c.spoolBatch(c.encoder, body)
+	}
+}
+
+// Push a body, retrying with exponential backoff. Returns false when the
+// batch should be kept for later.
+func (c *client) push(enc encoder, body []byte) bool {
+	backoff := c.config.MinBackoff
+	for attempt := 0; ; attempt++ {
+		resp, resBody, err := c.client.sendJsonReq(c.ctx, "POST", c.config, enc.contentType(), body)
+		if err == nil && resp.StatusCode == 204 {
+			return true
+		}
+		if !retryable(resp, err) {
+			// The server will never accept this batch, keeping it is pointless
+			log.Printf("promtail.Client: Unexpected HTTP status code: %d, message: %s\n", resp.StatusCode, resBody)
+			return true
+		}
+		if err != nil {
+			log.Printf("promtail.Client: unable to send an HTTP request: %s\n", err)
+		} else {
+			log.Printf("promtail.Client: Unexpected HTTP status code: %d, message: %s\n", resp.StatusCode, resBody)
+		}
+
+		if attempt >= c.config.MaxRetries || !c.wait(backoff) {
+			return false
+		}
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// Sleep before a retry. Returns false if the shutdown deadline would pass.
+func (c *client) wait(d time.Duration) bool {
+	select {
+	case <-c.quit:
+		if time.Now().Add(d).After(c.deadline) {
+			return false
+		}
+		time.Sleep(d)
+		return true
+	default:
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-c.quit:
+		// Shutdown started while waiting, retry right away if time allows
+		return time.Now().Before(c.deadline)
+	}
+}
+
+func (c *client) spoolBatch(enc encoder, body []byte) {
+	if c.spool == nil {
+		log.Printf("promtail.Client: dropping batch after %d retries\n", c.config.MaxRetries)
+		return
+	}
+	if err := c.spool.save(enc.format(), body); err != nil {
+		log.Printf("promtail.Client: unable to spool batch: %s\n", err)
+	}
+}
+
+// Deliver batches spooled by earlier runs, stopping at the first failure.
+// Only one process replays a spool at a time so a batch is not sent twice.
+func (c *client) replay() {
+	if c.spool == nil {
+		return
+	}
+	lock, err := c.spool.lock()
+	if err != nil {
+		if err != syscall.EWOULDBLOCK {
+			log.Printf("promtail.Client: unable to lock the spool: %s\n", err)
+		}
+		return
+	}
+	defer lock.Close()
+
+	// Keeps going after Shutdown starts, the deadline still bounds each push
+	for _, f := range c.spool.files() {
+		body, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		// Batches keep the format they were encoded in
+		if !c.push(encoderFor(spoolFormat(f)), body) {
+			return
+		}
+		os.Remove(f)
+	}
+}
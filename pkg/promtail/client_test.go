@@ -0,0 +1,154 @@
+package promtail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A push endpoint answering with status, counting requests
+func pushServer(t *testing.T, status int, block chan struct{}) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if block != nil {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	if block != nil {
+		t.Cleanup(func() { close(block) })
+	}
+	return srv, &requests
+}
+
+func testConfig(url string, spoolDir string) ClientConfig {
+	return ClientConfig{
+		PushURL:            url,
+		Labels:             map[string]string{"job": "vpn"},
+		BatchWait:          time.Hour,
+		BatchEntriesNumber: 100,
+		SendLevel:          INFO,
+		PrintLevel:         DISABLE,
+		MinBackoff:         time.Millisecond,
+		MaxBackoff:         time.Millisecond,
+		SpoolDir:           spoolDir,
+		ShutdownTimeout:    200 * time.Millisecond,
+	}
+}
+
+func TestShutdownAbortsHungPush(t *testing.T) {
+	srv, _ := pushServer(t, 204, make(chan struct{}))
+	dir := t.TempDir()
+	c, _ := NewClient(testConfig(srv.URL, dir))
+	c.Log(INFO, nil, "connected")
+
+	start := time.Now()
+	c.Shutdown()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+	if files := (&spool{dir: dir}).files(); len(files) != 1 {
+		t.Errorf("%d batches spooled, want 1", len(files))
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		want       int32
+	}{
+		{NoRetries, 1},
+		{2, 3},
+	}
+	for _, tt := range tests {
+		srv, requests := pushServer(t, 500, nil)
+		cfg := testConfig(srv.URL, "")
+		cfg.MaxRetries = tt.maxRetries
+		c, _ := NewClient(cfg)
+		c.Log(INFO, nil, "connected")
+		c.Shutdown()
+		if got := atomic.LoadInt32(requests); got != tt.want {
+			t.Errorf("MaxRetries %d: %d requests, want %d", tt.maxRetries, got, tt.want)
+		}
+	}
+}
+
+func TestReplayLock(t *testing.T) {
+	srv, requests := pushServer(t, 204, nil)
+	dir := t.TempDir()
+	s := newSpool(dir, 0)
+	if err := s.save(JSON, []byte(`{"streams":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process is replaying
+	lock, err := s.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := NewClient(testConfig(srv.URL, dir))
+	time.Sleep(50 * time.Millisecond)
+	c.Shutdown()
+	if atomic.LoadInt32(requests) != 0 || len(s.files()) != 1 {
+		t.Fatal("replayed a spool locked by another process")
+	}
+	lock.Close()
+
+	c, _ = NewClient(testConfig(srv.URL, dir))
+	for deadline := time.Now().Add(2 * time.Second); len(s.files()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Shutdown()
+	if len(s.files()) != 0 {
+		t.Error("spooled batch was not replayed")
+	}
+}
+
+func TestReplayBeforeNewEntries(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "spooled") {
+			// A slow replay must still land before the new entry
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(204)
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	s := newSpool(dir, 0)
+	if err := s.save(JSON, []byte(`{"streams":[{"stream":{"job":"vpn"},"values":[["1","spooled"]]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(srv.URL, dir)
+	cfg.BatchEntriesNumber = 1
+	cfg.ShutdownTimeout = 2 * time.Second
+	c, _ := NewClient(cfg)
+	c.Log(INFO, nil, "connected")
+	c.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 || !strings.Contains(bodies[0], "spooled") || !strings.Contains(bodies[1], "connected") {
+		t.Errorf("pushed %q, want the spooled batch first", bodies)
+	}
+	if len(s.files()) != 0 {
+		t.Error("spooled batch was not removed after delivery")
+	}
+}
@@ -2,9 +2,11 @@ package promtail
 
 import (
 	"bytes"
+	"context"
 	b64 "encoding/base64"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -21,6 +23,42 @@ const (
 	DISABLE LogLevel = iota
 )
 
+// Wire format used for pushes
+type Format int
+
+const (
+	JSON Format = iota
+	// Protobuf compressed with snappy, Loki's native push format
+	Protobuf
+)
+
+func (f Format) String() string {
+	if f == Protobuf {
+		return "protobuf"
+	}
+	return "json"
+}
+
+func ParseFormat(s string) Format {
+	switch strings.ToLower(s) {
+	case "protobuf", "proto":
+		return Protobuf
+	}
+	return JSON
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case DEBUG:
+		return "debug"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	}
+	return "info"
+}
+
 type ClientConfig struct {
 	// E.g. http://localhost:3100/api/prom/push
 	PushURL string
@@ -28,15 +66,28 @@ type ClientConfig struct {
 	Authorization string
 	// E.g. "{job=\"somejob\"}"
 	Labels             map[string]string
+	Format             Format
 	BatchWait          time.Duration
 	BatchEntriesNumber int
 	// Logs are sent to Promtail if the entry level is >= SendLevel
 	SendLevel LogLevel
 	// Logs are printed to stdout if the entry level is >= PrintLevel
 	PrintLevel LogLevel
+	// Retries for a failed push, doubling the backoff each time. Zero uses
+	// the default, NoRetries sends once.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Directory for batches that could not be delivered, empty disables spooling
+	SpoolDir      string
+	SpoolMaxBytes int64
+	// How long Shutdown may spend flushing before spooling what is left
+	ShutdownTimeout time.Duration
 }
 
 type Client interface {
+	// Log a line with labels of its own, merged into the configured ones
+	Log(level LogLevel, labels map[string]string, line string)
 	ZerologWrite(format string, args ...interface{})
 	Debugf(format string, args ...interface{})
 	Infof(format string, args ...interface{})
@@ -50,9 +101,43 @@ type httpClient struct {
 	parent http.Client
 }
 
+// MaxRetries value that turns retrying off
+const NoRetries = -1
+
+const (
+	defaultMaxRetries      = 5
+	defaultMinBackoff      = 500 * time.Millisecond
+	defaultMaxBackoff      = 30 * time.Second
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// Fill in defaults for the delivery settings
+func (c *ClientConfig) setDefaults() {
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = defaultMinBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+}
+
+// Network errors, throttling and server errors are worth retrying
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
 // A bit more convenient method for sending requests to the HTTP server
-func (client *httpClient) sendJsonReq(method string, c *ClientConfig, ctype string, reqBody []byte) (resp *http.Response, resBody []byte, err error) {
-	req, err := http.NewRequest(method, c.PushURL, bytes.NewBuffer(reqBody))
+func (client *httpClient) sendJsonReq(ctx context.Context, method string, c *ClientConfig, ctype string, reqBody []byte) (resp *http.Response, resBody []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.PushURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,145 @@
+package promtail
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Entries sharing one label set
+type stream struct {
+	labels  map[string]string
+	entries []*logEntry
+}
+
+type encoder interface {
+	encode(streams []*stream) ([]byte, error)
+	contentType() string
+	format() Format
+}
+
+func encoderFor(f Format) encoder {
+	if f == Protobuf {
+		return protoEncoder{}
+	}
+	return jsonEncoder{}
+}
+
+// Group entries into streams by their merged label set, keeping entry order
+func groupStreams(base map[string]string, entries []*logEntry) []*stream {
+	streams := []*stream{}
+	byKey := map[string]*stream{}
+	for _, e := range entries {
+		labels := make(map[string]string, len(base)+len(e.labels))
+		for k, v := range base {
+			labels[k] = v
+		}
+		for k, v := range e.labels {
+			if v != "" {
+				labels[k] = v
+			}
+		}
+		labels["level"] = e.level.String()
+		key := labelString(labels)
+		s, ok := byKey[key]
+		if !ok {
+			s = &stream{labels: labels}
+			byKey[key] = s
+			streams = append(streams, s)
+		}
+		s.entries = append(s.entries, e)
+	}
+	return streams
+}
+
+// Format labels as a Loki stream selector, e.g. {job="vpn", result="allowed"}
+func labelString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + strconv.Quote(labels[k])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+type promtailStream struct {
+	Labels  map[string]string `json:"stream"`
+	Entries [][]string        `json:"values"`
+}
+
+type promtailMsg struct {
+	Streams []promtailStream `json:"streams"`
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) encode(streams []*stream) ([]byte, error) {
+	msg := promtailMsg{}
+	for _, s := range streams {
+		e := make([][]string, len(s.entries))
+		for i, v := range s.entries {
+			e[i] = []string{strconv.FormatInt(v.ts.UnixNano(), 10), v.line}
+		}
+		msg.Streams = append(msg.Streams, promtailStream{Labels: s.labels, Entries: e})
+	}
+	return json.Marshal(msg)
+}
+
+func (jsonEncoder) contentType() string {
+	return "application/json"
+}
+
+func (jsonEncoder) format() Format {
+	return JSON
+}
+
+// Encodes logproto.PushRequest by hand:
+//
+//	PushRequest   { repeated StreamAdapter streams = 1; }
+//	StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	EntryAdapter  { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+type protoEncoder struct{}
+
+func (protoEncoder) encode(streams []*stream) ([]byte, error) {
+	var req []byte
+	for _, s := range streams {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.BytesType)
+		sb = protowire.AppendString(sb, labelString(s.labels))
+		for _, e := range s.entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Unix()))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Nanosecond()))
+
+			var eb []byte
+			eb = protowire.AppendTag(eb, 1, protowire.BytesType)
+			eb = protowire.AppendBytes(eb, ts)
+			eb = protowire.AppendTag(eb, 2, protowire.BytesType)
+			eb = protowire.AppendString(eb, e.line)
+
+			sb = protowire.AppendTag(sb, 2, protowire.BytesType)
+			sb = protowire.AppendBytes(sb, eb)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, sb)
+	}
+	return snappy.Encode(nil, req), nil
+}
+
+func (protoEncoder) contentType() string {
+	return "application/x-protobuf"
+}
+
+func (protoEncoder) format() Format {
+	return Protobuf
+}
@@ -0,0 +1,188 @@
+package promtail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// logproto.PushRequest as Loki defines it in push.proto
+func pushRequestDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   kind.Enum(),
+			Label:  label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	message := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("pkg/push/push.proto"),
+		Package:    proto.String("logproto"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("PushRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("streams", 1, message, repeated, ".logproto.StreamAdapter"),
+			}},
+			{Name: proto.String("StreamAdapter"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("labels", 1, str, optional, ""),
+				field("entries", 2, message, repeated, ".logproto.EntryAdapter"),
+			}},
+			{Name: proto.String("EntryAdapter"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("timestamp", 1, message, optional, ".google.protobuf.Timestamp"),
+				field("line", 2, str, optional, ""),
+			}},
+		},
+	}
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd.Messages().ByName("PushRequest")
+}
+
+type decodedEntry struct {
+	ts   time.Time
+	line string
+}
+
+func TestProtoEncoder(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	entries := []*logEntry{
+		{ts: ts, line: `{"message":"connected"}`, level: INFO, labels: map[string]string{"result": "allowed"}},
+		{ts: ts.Add(time.Second), line: "ünïcode", level: INFO, labels: map[string]string{"result": "allowed"}},
+		{ts: ts.Add(2 * time.Second), line: "denied", level: WARN, labels: map[string]string{"result": "denied"}},
+	}
+	body, err := protoEncoder{}.encode(groupStreams(map[string]string{"job": "vpn"}, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := pushRequestDescriptor(t)
+	req := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(raw, req); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string][]decodedEntry{}
+	streams := req.Get(desc.Fields().ByName("streams")).List()
+	for i := 0; i < streams.Len(); i++ {
+		s := streams.Get(i).Message()
+		sd := s.Descriptor()
+		labels := s.Get(sd.Fields().ByName("labels")).String()
+		list := s.Get(sd.Fields().ByName("entries")).List()
+		for j := 0; j < list.Len(); j++ {
+			e := list.Get(j).Message()
+			ed := e.Descriptor()
+			stamp := e.Get(ed.Fields().ByName("timestamp")).Message()
+			sec := stamp.Get(stamp.Descriptor().Fields().ByName("seconds")).Int()
+			nanos := stamp.Get(stamp.Descriptor().Fields().ByName("nanos")).Int()
+			got[labels] = append(got[labels], decodedEntry{time.Unix(sec, nanos), e.Get(ed.Fields().ByName("line")).String()})
+			if len(e.GetUnknown()) > 0 || len(stamp.GetUnknown()) > 0 {
+				t.Error("entry has fields push.proto does not define")
+			}
+		}
+		if len(s.GetUnknown()) > 0 {
+			t.Error("stream has fields push.proto does not define")
+		}
+	}
+
+	want := map[string][]decodedEntry{
+		`{job="vpn", level="info", result="allowed"}`: {{entries[0].ts, entries[0].line}, {entries[1].ts, entries[1].line}},
+		`{job="vpn", level="warn", result="denied"}`:  {{entries[2].ts, entries[2].line}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got streams %v, want %v", got, want)
+	}
+	for labels, w := range want {
+		g := got[labels]
+		if len(g) != len(w) {
+			t.Errorf("%v: got %d entries, want %d", labels, len(g), len(w))
+			continue
+		}
+		for i := range w {
+			if !g[i].ts.Equal(w[i].ts) || g[i].line != w[i].line {
+				t.Errorf("%v entry %d: got %v %q, want %v %q", labels, i, g[i].ts, g[i].line, w[i].ts, w[i].line)
+			}
+		}
+	}
+}
+
+func TestGroupStreams(t *testing.T) {
+	base := map[string]string{"job": "vpn", "source": "wireguard-vpn"}
+	entries := []*logEntry{
+		{line: "a", level: INFO, labels: map[string]string{"result": "allowed", "profile": "alice"}},
+		{line: "b", level: INFO, labels: map[string]string{"profile": "alice", "result": "allowed"}},
+		{line: "c", level: INFO, labels: map[string]string{"result": "denied", "profile": "alice"}},
+		{line: "d", level: ERROR, labels: map[string]string{"result": "allowed", "profile": "alice"}},
+		// Empty labels are dropped instead of overriding the base
+		{line: "e", level: INFO, labels: map[string]string{"job": "", "country": ""}},
+		{line: "f", level: INFO, labels: map[string]string{"job": "sync"}},
+		{line: "g", level: INFO},
+	}
+	streams := groupStreams(base, entries)
+
+	want := []struct {
+		labels string
+		lines  string
+	}{
+		{`{job="vpn", level="info", profile="alice", result="allowed", source="wireguard-vpn"}`, "ab"},
+		{`{job="vpn", level="info", profile="alice", result="denied", source="wireguard-vpn"}`, "c"},
+		{`{job="vpn", level="error", profile="alice", result="allowed", source="wireguard-vpn"}`, "d"},
+		{`{job="vpn", level="info", source="wireguard-vpn"}`, "eg"},
+		{`{job="sync", level="info", source="wireguard-vpn"}`, "f"},
+	}
+	if len(streams) != len(want) {
+		t.Fatalf("got %d streams, want %d", len(streams), len(want))
+	}
+	for i, w := range want {
+		lines := ""
+		for _, e := range streams[i].entries {
+			lines += e.line
+		}
+		if got := labelString(streams[i].labels); got != w.labels || lines != w.lines {
+			t.Errorf("stream %d: got %v with %q, want %v with %q", i, got, lines, w.labels, w.lines)
+		}
+	}
+	if base["level"] != "" {
+		t.Error("groupStreams changed the base labels")
+	}
+}
+
+func TestLabelString(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		want   string
+	}{
+		{map[string]string{}, "{}"},
+		{map[string]string{"b": "2", "a": "1"}, `{a="1", b="2"}`},
+		{map[string]string{"profile": `o"brien\laptop`}, `{profile="o\"brien\\laptop"}`},
+	}
+	for _, tt := range tests {
+		if got := labelString(tt.labels); got != tt.want {
+			t.Errorf("labelString(%v) = %s, want %s", tt.labels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package promtail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultSpoolMaxBytes = 10 * 1024 * 1024
+
+// Batches that could not be delivered are written to a directory, one file
+// per push body, and replayed the next time a client starts. The directory is
+// kept under maxBytes by dropping the oldest batches.
+type spool struct {
+	dir      string
+	maxBytes int64
+}
+
+func newSpool(dir string, maxBytes int64) *spool {
+	if dir == "" {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	return &spool{dir: dir, maxBytes: maxBytes}
+}
+
+func (s *spool) save(format Format, body []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, strconv.FormatInt(time.Now().UnixNano(), 10)+"."+format.String()+".batch")
+	if err := ioutil.WriteFile(name+".tmp", body, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	s.trim()
+	return nil
+}
+
+// Spooled batches, oldest first
+func (s *spool) files() []string {
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*.batch"))
+	sort.Strings(files)
+	return files
+}
+
+// Take the replay lock without waiting. Closing the file releases it.
+func (s *spool) lock() (*os.File, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, "replay.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// The format a spooled batch was encoded in, from its file name
+func spoolFormat(file string) Format {
+	parts := strings.Split(filepath.Base(file), ".")
+	if len(parts) == 3 {
+		return ParseFormat(parts[1])
+	}
+	return JSON
+}
+
+func (s *spool) trim() {
+	files := s.files()
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; total > s.maxBytes && i < len(files); i++ {
+		if os.Remove(files[i]) == nil {
+			total -= sizes[i]
+		}
+	}
+}
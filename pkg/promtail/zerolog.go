@@ -0,0 +1,59 @@
+package promtail
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/rs/zerolog"
+)
+
+// An io.Writer for zerolog that forwards each event to a Client at the
+// event's own level
+type CustomWriter struct {
+	Client Client
+}
+
+func (w CustomWriter) Write(p []byte) (n int, err error) {
+	w.Client.Log(parseZerologLevel(p), nil, string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+// zerolog hands the level over directly when the writer implements LevelWriter
+func (w CustomWriter) WriteLevel(l zerolog.Level, p []byte) (n int, err error) {
+	if l == zerolog.NoLevel {
+		return w.Write(p)
+	}
+	w.Client.Log(fromZerolog(l), nil, string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+func fromZerolog(l zerolog.Level) LogLevel {
+	switch {
+	case l <= zerolog.DebugLevel:
+		return DEBUG
+	case l == zerolog.InfoLevel:
+		return INFO
+	case l == zerolog.WarnLevel:
+		return WARN
+	case l == zerolog.Disabled:
+		return DISABLE
+	}
+	return ERROR
+}
+
+// Read the level field from a zerolog JSON line, INFO if there is none
+func parseZerologLevel(p []byte) LogLevel {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return INFO
+	}
+	name, ok := fields[zerolog.LevelFieldName].(string)
+	if !ok {
+		return INFO
+	}
+	l, err := zerolog.ParseLevel(name)
+	if err != nil || l == zerolog.NoLevel {
+		return INFO
+	}
+	return fromZerolog(l)
+}
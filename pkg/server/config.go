@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/spf13/viper"
+)
+
+// Name of the server described by the top-level keys when there is no
+// servers list
+const DefaultName = "default"
+
+// One wireguard server instance
+type Config struct {
+	Name             string            `mapstructure:"name"`
+	WgInterface      string            `mapstructure:"wgInterface"`
+	ExtInterface     string            `mapstructure:"extInterface"`
+	PrivateKey       string            `mapstructure:"privateKey"`
+	NextPrivateKey   string            `mapstructure:"nextPrivateKey"`
+	Port             int               `mapstructure:"port"`
+	ManageInterface  bool              `mapstructure:"manageInterface"`
+	Address          string            `mapstructure:"address"`
+	PoolPrefixLength int               `mapstructure:"poolPrefixLength"`
+	MTU              int               `mapstructure:"mtu"`
+	IPPoolStart      string            `mapstructure:"ipPoolStart"`
+	AllowInternet    bool              `mapstructure:"allowInternet"`
+	RuleProfiles     map[string][]Rule `mapstructure:"ruleProfiles"`
+	ClientConfig     ClientConfig      `mapstructure:"clientConfig"`
+}
+
+type ClientConfig struct {
+	Routes        []string `mapstructure:"routes"`
+	DNS           string   `mapstructure:"dns"`
+	ServerAddress string   `mapstructure:"serverAddress"`
+}
+
+type Rule struct {
+	Route string `mapstructure:"route"`
+	Proto string `mapstructure:"proto"`
+	Port  int    `mapstructure:"port"`
+}
+
+// Every configured server. Without a servers list the top-level server,
+// ipPoolStart, allowInternet, ruleProfiles and clientConfig keys describe a
+// single server named "default".
+func All() ([]Config, error) {
+	if !viper.IsSet("servers") {
+		return []Config{legacy()}, nil
+	}
+
+	var servers []Config
+	if err := viper.UnmarshalKey("servers", &servers); err != nil {
+		return nil, fmt.Errorf("reading servers: %w", err)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("servers is empty")
+	}
+	names := map[string]bool{}
+	interfaces := map[string]bool{}
+	for i, v := range servers {
+		switch {
+		case v.Name == "":
+			return nil, errors.New("every server needs a name")
+		case names[v.Name]:
+			return nil, fmt.Errorf("server %v is defined twice", v.Name)
+		case v.WgInterface == "":
+			return nil, fmt.Errorf("server %v has no wgInterface", v.Name)
+		case interfaces[v.WgInterface]:
+			return nil, fmt.Errorf("interface %v is used by more than one server", v.WgInterface)
+		case net.ParseIP(v.IPPoolStart).To4() == nil:
+			return nil, fmt.Errorf("server %v has no IPv4 ipPoolStart", v.Name)
+		case v.PoolPrefixLength < 0 || v.PoolPrefixLength > 30:
+			return nil, fmt.Errorf("server %v has an invalid poolPrefixLength %v", v.Name, v.PoolPrefixLength)
+		}
+		first, last := v.Pool()
+		if last < first {
+			return nil, fmt.Errorf("server %v has no addresses after ipPoolStart in its pool", v.Name)
+		}
+		// Firewall chains are named by client IP, so pools must not collide
+		for _, o := range servers[:i] {
+			oFirst, oLast := o.Pool()
+			if first <= oLast && oFirst <= last {
+				return nil, fmt.Errorf("pool of server %v overlaps the pool of server %v", v.Name, o.Name)
+			}
+		}
+		names[v.Name] = true
+		interfaces[v.WgInterface] = true
+	}
+	return servers, nil
+}
+
+// Look up a server by name. An empty name is the first server, which also
+// owns users added before servers could be named.
+func Get(name string) (Config, error) {
+	servers, err := All()
+	if err != nil {
+		return Config{}, err
+	}
+	if name == "" {
+		return servers[0], nil
+	}
+	for _, v := range servers {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return Config{}, fmt.Errorf("no server named %v", name)
+}
+
+// The rules of a rule profile. Profiles the server does not define are
+// looked up in the top-level ruleProfiles.
+func (c Config) Rules(profile string) ([]Rule, error) {
+	for k, v := range c.RuleProfiles {
+		if strings.EqualFold(k, profile) {
+			return v, nil
+		}
+	}
+	var rules []Rule
+	err := viper.UnmarshalKey("ruleProfiles."+profile, &rules)
+	return rules, err
+}
+
+// The client addresses a server hands out: ipPoolStart up to the last
+// address before the broadcast address of its /24 (or poolPrefixLength)
+func (c Config) Pool() (first, last uint32) {
+	prefix := c.PoolPrefixLength
+	if prefix <= 0 {
+		prefix = defaultPoolPrefix
+	}
+	first = util.Ip2int(net.ParseIP(c.IPPoolStart).To4())
+	return first, (first | ^uint32(0)>>prefix) - 1
+}
+
+func legacy() Config {
+	return Config{
+		Name:             DefaultName,
+		WgInterface:      viper.GetString("server.wgInterface"),
+		ExtInterface:     viper.GetString("server.extInterface"),
+		PrivateKey:       viper.GetString("server.privateKey"),
+		NextPrivateKey:   viper.GetString("server.nextPrivateKey"),
+		Port:             viper.GetInt("server.port"),
+		ManageInterface:  viper.GetBool("server.manageInterface"),
+		Address:          viper.GetString("server.address"),
+		PoolPrefixLength: viper.GetInt("server.poolPrefixLength"),
+		MTU:              viper.GetInt("server.mtu"),
+		IPPoolStart:      viper.GetString("ipPoolStart"),
+		AllowInternet:    viper.GetBool("allowInternet"),
+		ClientConfig: ClientConfig{
+			Routes:        viper.GetStringSlice("clientConfig.routes"),
+			DNS:           viper.GetString("clientConfig.dns"),
+			ServerAddress: viper.GetString("clientConfig.serverAddress"),
+		},
+	}
+}
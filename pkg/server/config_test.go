@@ -0,0 +1,88 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/spf13/viper"
+)
+
+func TestAll(t *testing.T) {
+	engineering := map[string]interface{}{"name": "engineering", "wgInterface": "wg0", "ipPoolStart": "172.20.0.2"}
+	with := func(base map[string]interface{}, changes ...interface{}) map[string]interface{} {
+		server := map[string]interface{}{}
+		for k, v := range base {
+			server[k] = v
+		}
+		for i := 0; i < len(changes); i += 2 {
+			server[changes[i].(string)] = changes[i+1]
+		}
+		return server
+	}
+	contractors := with(engineering, "name", "contractors", "wgInterface", "wg1", "ipPoolStart", "172.21.0.2")
+
+	tests := []struct {
+		name    string
+		servers []map[string]interface{}
+		err     string
+	}{
+		{"separate pools", []map[string]interface{}{engineering, contractors}, ""},
+		{"adjacent pools", []map[string]interface{}{engineering, with(contractors, "ipPoolStart", "172.20.1.2")}, ""},
+		{"empty", []map[string]interface{}{}, "servers is empty"},
+		{"no name", []map[string]interface{}{with(engineering, "name", "")}, "needs a name"},
+		{"duplicate name", []map[string]interface{}{engineering, with(contractors, "name", "engineering")}, "defined twice"},
+		{"no interface", []map[string]interface{}{with(engineering, "wgInterface", "")}, "no wgInterface"},
+		{"shared interface", []map[string]interface{}{engineering, with(contractors, "wgInterface", "wg0")}, "more than one server"},
+		{"IPv6 pool", []map[string]interface{}{with(engineering, "ipPoolStart", "fd00::2")}, "no IPv4 ipPoolStart"},
+		{"bad prefix", []map[string]interface{}{with(engineering, "poolPrefixLength", 31)}, "invalid poolPrefixLength"},
+		{"start at broadcast", []map[string]interface{}{with(engineering, "ipPoolStart", "172.20.0.255")}, "no addresses"},
+		{"same start", []map[string]interface{}{engineering, with(contractors, "ipPoolStart", "172.20.0.2")}, "overlaps"},
+		{"start inside pool", []map[string]interface{}{engineering, with(contractors, "ipPoolStart", "172.20.0.100")}, "overlaps"},
+		{"pool around pool", []map[string]interface{}{engineering, with(contractors, "ipPoolStart", "172.20.0.0", "poolPrefixLength", 16)}, "overlaps"},
+		{"wider pool first", []map[string]interface{}{with(engineering, "poolPrefixLength", 16), with(contractors, "ipPoolStart", "172.20.200.2")}, "overlaps"},
+		{"split network", []map[string]interface{}{with(engineering, "poolPrefixLength", 25), with(contractors, "ipPoolStart", "172.20.0.130", "poolPrefixLength", 25)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("servers", tt.servers)
+			t.Cleanup(func() { viper.Set("servers", nil) })
+			servers, err := All()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(servers) != len(tt.servers) {
+					t.Errorf("got %d servers, want %d", len(servers), len(tt.servers))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPool(t *testing.T) {
+	tests := []struct {
+		start       string
+		prefix      int
+		first, last string
+	}{
+		{"172.20.0.2", 0, "172.20.0.2", "172.20.0.254"},
+		{"172.20.0.2", 16, "172.20.0.2", "172.20.255.254"},
+		{"10.0.0.130", 25, "10.0.0.130", "10.0.0.254"},
+		{"10.0.0.10", 28, "10.0.0.10", "10.0.0.14"},
+	}
+	for _, tt := range tests {
+		first, last := Config{IPPoolStart: tt.start, PoolPrefixLength: tt.prefix}.Pool()
+		if got := util.Int2ip(first).String(); got != tt.first {
+			t.Errorf("%v/%d: first %v, want %v", tt.start, tt.prefix, got, tt.first)
+		}
+		if got := util.Int2ip(last).String(); got != tt.last {
+			t.Errorf("%v/%d: last %v, want %v", tt.start, tt.prefix, got, tt.last)
+		}
+	}
+}
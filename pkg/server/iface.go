@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	defaultMTU        = 1420
+	defaultPoolPrefix = 24
+	ipForwardPath     = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// Create and configure a server's wireguard interface so it matches the
+// config. Every step checks the current state first, so running it again on
+// a configured host changes nothing.
+func EnsureInterface(cfg Config) error {
+	name := cfg.WgInterface
+	if name == "" {
+		return fmt.Errorf("server %v has no wgInterface", cfg.Name)
+	}
+	addr, err := cfg.InterfaceAddress()
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(name)
+	if _, missing := err.(netlink.LinkNotFoundError); missing {
+		log.Info().Msgf("Creating wireguard interface %v", name)
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs}); err != nil {
+			return fmt.Errorf("creating %v: %w", name, err)
+		}
+		link, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return fmt.Errorf("looking up %v: %w", name, err)
+	}
+
+	if err := ensureAddress(link, addr); err != nil {
+		return err
+	}
+
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	if link.Attrs().MTU != mtu {
+		log.Info().Msgf("Setting MTU of %v to %d", name, mtu)
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("setting MTU: %w", err)
+		}
+	}
+
+	if err := configureDevice(cfg); err != nil {
+		return err
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		log.Info().Msgf("Bringing %v up", name)
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("bringing %v up: %w", name, err)
+		}
+	}
+
+	return enableForwarding()
+}
+
+// The interface address: address if set, otherwise the address just before
+// ipPoolStart with a /24 (or poolPrefixLength) netmask
+func (c Config) InterfaceAddress() (*netlink.Addr, error) {
+	if c.Address != "" {
+		addr, err := netlink.ParseAddr(c.Address)
+		if err != nil {
+			return nil, fmt.Errorf("parsing address of server %v: %w", c.Name, err)
+		}
+		return addr, nil
+	}
+
+	start := net.ParseIP(c.IPPoolStart)
+	if start == nil || start.To4() == nil {
+		return nil, errors.New("ipPoolStart is not an IPv4 address")
+	}
+	prefix := c.PoolPrefixLength
+	if prefix <= 0 {
+		prefix = defaultPoolPrefix
+	}
+	ip := util.Int2ip(util.Ip2int(start) - 1)
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, 32)}}, nil
+}
+
+func ensureAddress(link netlink.Link, addr *netlink.Addr) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("listing addresses: %w", err)
+	}
+	for _, v := range addrs {
+		if v.IPNet.String() == addr.IPNet.String() {
+			return nil
+		}
+	}
+	log.Info().Msgf("Adding %v to %v", addr.IPNet, link.Attrs().Name)
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("adding address: %w", err)
+	}
+	return nil
+}
+
+// Set the private key and listen port, leaving peers to sync
+func configureDevice(cfg Config) error {
+	name := cfg.WgInterface
+	key, err := wgtypes.ParseKey(cfg.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("parsing server key: %w", err)
+	}
+	port := cfg.Port
+
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer wgClient.Close()
+
+	d, err := wgClient.Device(name)
+	if err != nil {
+		return err
+	}
+	if d.PrivateKey == key && d.ListenPort == port {
+		return nil
+	}
+	log.Info().Msgf("Configuring key and port %d on %v", port, name)
+	return wgClient.ConfigureDevice(name, wgtypes.Config{
+		PrivateKey: &key,
+		ListenPort: &port,
+	})
+}
+
+func enableForwarding() error {
+	current, err := ioutil.ReadFile(ipForwardPath)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(current)) == "1" {
+		return nil
+	}
+	log.Info().Msg("Enabling IPv4 forwarding")
+	return ioutil.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+}
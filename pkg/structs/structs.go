@@ -148,7 +148,7 @@ type OktaResponseFull struct {
 				AppID             interface{} `json:"appId"`
 				Version           interface{} `json:"version"`
 				AuthenticatorName string      `json:"authenticatorName"`
-			} `json:"profile,omitempty"`
+			} `json:"-"`
 		} `json:"factors"`
 		Policy struct {
 			AllowRememberDevice             bool `json:"allowRememberDevice"`
@@ -229,4 +229,17 @@ type WaitingFactor struct {
 			} `json:"hints"`
 		} `json:"poll"`
 	} `json:"_links"`
+	Embedded struct {
+		Challenge struct {
+			CorrectAnswer int `json:"correctAnswer"`
+		} `json:"challenge"`
+	} `json:"_embedded"`
+}
+
+type UserGroupsResponse []struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
 }
@@ -0,0 +1,37 @@
+package user
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+type counterRecord struct {
+	Pubkey string
+	Count  int
+}
+
+// Count an MFA outcome so the sync daemon can export it
+func CountResult(result string, svc *dynamodb.DynamoDB) {
+	if result == "" {
+		result = "error"
+	}
+	if _, err := incrState(stateKey("metric", "mfa", strings.ToLower(result)), "Count", 0, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to count MFA result")
+	}
+}
+
+// Totals of every MFA outcome counted so far
+func ResultCounts(svc *dynamodb.DynamoDB) (map[string]float64, error) {
+	records := []counterRecord{}
+	prefix := stateKey("metric", "mfa", "")
+	if err := scanState(prefix, &records, svc); err != nil {
+		return nil, err
+	}
+	counts := map[string]float64{}
+	for _, v := range records {
+		counts[strings.TrimPrefix(v.Pubkey, prefix)] = float64(v.Count)
+	}
+	return counts, nil
+}
@@ -0,0 +1,652 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/spf13/viper"
+)
+
+// An in-memory table speaking enough of the DynamoDB JSON API for the
+// expressions this package uses. Items are keyed by Pubkey.
+type fakeTable struct {
+	mu     sync.Mutex
+	items  map[string]map[string]*dynamodb.AttributeValue
+	writes int
+}
+
+// Start a fake table and return a client for it. dynamoDBTable is set for
+// the duration of the test.
+func newFakeTable(t *testing.T) (*fakeTable, *dynamodb.DynamoDB) {
+	t.Helper()
+	table := &fakeTable{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	srv := httptest.NewServer(table)
+	t.Cleanup(srv.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	viper.Set("dynamoDBTable", "test")
+	t.Cleanup(func() { viper.Set("dynamoDBTable", nil) })
+	return table, dynamodb.New(sess)
+}
+
+// Set config keys for the duration of the test
+func configure(t *testing.T, settings map[string]interface{}) {
+	t.Helper()
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range settings {
+			viper.Set(k, nil)
+		}
+	})
+}
+
+// Store an item as the SDK would marshal it
+func (f *fakeTable) put(t *testing.T, item interface{}) {
+	t.Helper()
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[aws.StringValue(av["Pubkey"].S)] = av
+}
+
+// Read an item back into out, reporting whether it exists
+func (f *fakeTable) get(t *testing.T, key string, out interface{}) bool {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, found := f.items[key]
+	if !found {
+		return false
+	}
+	if err := dynamodbattribute.UnmarshalMap(item, out); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func (f *fakeTable) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, found := f.items[key]
+	return found
+}
+
+func (f *fakeTable) writeCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+type fakeError struct {
+	code    string
+	msg     string
+	reasons []string
+}
+
+func (e fakeError) Error() string { return e.msg }
+
+var errConditionFailed = fakeError{"ConditionalCheckFailedException", "The conditional request failed", nil}
+
+func (f *fakeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	f.mu.Lock()
+	out, err := f.handle(op, r)
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if err != nil {
+		fe, ok := err.(fakeError)
+		if !ok {
+			fe = fakeError{"ValidationException", err.Error(), nil}
+		}
+		body := map[string]interface{}{"__type": "com.amazonaws.dynamodb.v20120810#" + fe.code, "message": fe.msg}
+		if fe.reasons != nil {
+			reasons := []map[string]string{}
+			for _, v := range fe.reasons {
+				reasons = append(reasons, map[string]string{"Code": v})
+			}
+			body["CancellationReasons"] = reasons
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func (f *fakeTable) handle(op string, r *http.Request) (interface{}, error) {
+	dec := json.NewDecoder(r.Body)
+	switch op {
+	case "GetItem":
+		in := dynamodb.GetItemInput{}
+		if err := dec.Decode(&in); err != nil {
+			return nil, err
+		}
+		return dynamodb.GetItemOutput{Item: f.items[keyOf(in.Key)]}, nil
+	case "PutItem":
+		in := dynamodb.PutItemInput{}
+		if err := dec.Decode(&in); err != nil {
+			return nil, err
+		}
+		return dynamodb.PutItemOutput{}, f.putItem(in.Item, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	case "DeleteItem":
+		in := dynamodb.DeleteItemInput{}
+		if err := dec.Decode(&in); err != nil {
+			return nil, err
+		}
+		return dynamodb.DeleteItemOutput{}, f.deleteItem(in.Key, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	case "UpdateItem":
+		in := dynamodb.UpdateItemInput{}
+		if err := dec.Decode(&in); err != nil {
+			return nil, err
+		}
+		item, err := f.updateItem(in.Key, aws.StringValue(in.UpdateExpression), in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		return dynamodb.UpdateItemOutput{Attributes: item}, err
+	case "Scan":
+		in := dynamodb.ScanInput{}
+		if err := dec.Decode(&in); err != nil {
+			return nil, err
+		}
+		keys := []string{}
+		for k := range f.items {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, k := range keys {
+			if in.FilterExpression != nil {
+				ok, err := evalCondition(*in.FilterExpression, f.items[k], in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			items = append(items, f.items[k])
+		}
+		return dynamodb.ScanOutput{Items: items, Count: aws.Int64(int64(len(items)))}, nil
+	case "TransactWriteItems":
+		in := dynamodb.TransactWriteItemsInput{}
+		if err := dec.Decode(&in); err != nil {
+			return nil, err
+		}
+		return dynamodb.TransactWriteItemsOutput{}, f.transact(in.TransactItems)
+	}
+	return nil, fmt.Errorf("unsupported operation %q", op)
+}
+
+func keyOf(key map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(key["Pubkey"].S)
+}
+
+func (f *fakeTable) check(key string, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	if condition == nil {
+		return nil
+	}
+	ok, err := evalCondition(*condition, f.items[key], names, values)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errConditionFailed
+	}
+	return nil
+}
+
+func (f *fakeTable) putItem(item map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	key := keyOf(item)
+	if err := f.check(key, condition, names, values); err != nil {
+		return err
+	}
+	f.items[key] = item
+	f.writes++
+	return nil
+}
+
+func (f *fakeTable) deleteItem(k map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	key := keyOf(k)
+	if err := f.check(key, condition, names, values); err != nil {
+		return err
+	}
+	delete(f.items, key)
+	f.writes++
+	return nil
+}
+
+func (f *fakeTable) updateItem(k map[string]*dynamodb.AttributeValue, update string, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	key := keyOf(k)
+	if err := f.check(key, condition, names, values); err != nil {
+		return nil, err
+	}
+	item := map[string]*dynamodb.AttributeValue{}
+	for a, v := range f.items[key] {
+		item[a] = v
+	}
+	item["Pubkey"] = k["Pubkey"]
+	if err := applyUpdate(update, item, names, values); err != nil {
+		return nil, err
+	}
+	f.items[key] = item
+	f.writes++
+	return item, nil
+}
+
+// All or nothing: every condition is checked before anything is written
+func (f *fakeTable) transact(items []*dynamodb.TransactWriteItem) error {
+	for i, v := range items {
+		var err error
+		switch {
+		case v.Put != nil:
+			err = f.check(keyOf(v.Put.Item), v.Put.ConditionExpression, v.Put.ExpressionAttributeNames, v.Put.ExpressionAttributeValues)
+		case v.Update != nil:
+			err = f.check(keyOf(v.Update.Key), v.Update.ConditionExpression, v.Update.ExpressionAttributeNames, v.Update.ExpressionAttributeValues)
+		case v.Delete != nil:
+			err = f.check(keyOf(v.Delete.Key), v.Delete.ConditionExpression, v.Delete.ExpressionAttributeNames, v.Delete.ExpressionAttributeValues)
+		case v.ConditionCheck != nil:
+			err = f.check(keyOf(v.ConditionCheck.Key), v.ConditionCheck.ConditionExpression, v.ConditionCheck.ExpressionAttributeNames, v.ConditionCheck.ExpressionAttributeValues)
+		}
+		if fe, ok := err.(fakeError); ok && fe.code == errConditionFailed.code {
+			reasons := make([]string, len(items))
+			for j := range reasons {
+				reasons[j] = "None"
+			}
+			reasons[i] = "ConditionalCheckFailed"
+			return fakeError{"TransactionCanceledException", "Transaction cancelled", reasons}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range items {
+		var err error
+		switch {
+		case v.Put != nil:
+			err = f.putItem(v.Put.Item, nil, nil, nil)
+		case v.Update != nil:
+			_, err = f.updateItem(v.Update.Key, aws.StringValue(v.Update.UpdateExpression), nil, v.Update.ExpressionAttributeNames, v.Update.ExpressionAttributeValues)
+		case v.Delete != nil:
+			err = f.deleteItem(v.Delete.Key, nil, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expressions
+
+type exprParser struct {
+	tokens []string
+	pos    int
+	item   map[string]*dynamodb.AttributeValue
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func tokenize(expr string) []string {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),+", c):
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("<>=", c):
+			j := i + 1
+			for j < len(expr) && strings.ContainsRune("<>=", rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(expr) && !unicode.IsSpace(rune(expr[j])) && !strings.ContainsRune("(),+<>=", rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return fmt.Errorf("expected %q, got %q", t, got)
+	}
+	return nil
+}
+
+func (p *exprParser) name(t string) string {
+	if strings.HasPrefix(t, "#") {
+		return aws.StringValue(p.names[t])
+	}
+	return t
+}
+
+func evalCondition(expr string, item map[string]*dynamodb.AttributeValue, names map[string]*string, values map[string]*dynamodb.AttributeValue) (bool, error) {
+	p := &exprParser{tokens: tokenize(expr), item: item, names: names, values: values}
+	ok, err := p.or()
+	if err == nil && p.pos != len(p.tokens) {
+		err = fmt.Errorf("unexpected %q in %q", p.peek(), expr)
+	}
+	return ok, err
+}
+
+func (p *exprParser) or() (bool, error) {
+	ok, err := p.and()
+	for err == nil && strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		var right bool
+		right, err = p.and()
+		ok = ok || right
+	}
+	return ok, err
+}
+
+func (p *exprParser) and() (bool, error) {
+	ok, err := p.not()
+	for err == nil && strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		var right bool
+		right, err = p.not()
+		ok = ok && right
+	}
+	return ok, err
+}
+
+func (p *exprParser) not() (bool, error) {
+	if strings.EqualFold(p.peek(), "NOT") {
+		p.next()
+		ok, err := p.not()
+		return !ok, err
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (bool, error) {
+	switch t := p.peek(); t {
+	case "(":
+		p.next()
+		ok, err := p.or()
+		if err != nil {
+			return false, err
+		}
+		return ok, p.expect(")")
+	case "attribute_exists", "attribute_not_exists":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		_, found := p.item[p.name(p.next())]
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		return found == (t == "attribute_exists"), nil
+	case "attribute_type":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		v := p.item[p.name(p.next())]
+		if err := p.expect(","); err != nil {
+			return false, err
+		}
+		kind, err := p.operand()
+		if err != nil {
+			return false, err
+		}
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		return v != nil && aws.StringValue(kind.S) == "NULL" && aws.BoolValue(v.NULL), nil
+	case "begins_with", "contains":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		left, err := p.operand()
+		if err != nil {
+			return false, err
+		}
+		if err := p.expect(","); err != nil {
+			return false, err
+		}
+		right, err := p.operand()
+		if err != nil {
+			return false, err
+		}
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		if left == nil || left.S == nil || right == nil {
+			return false, nil
+		}
+		if t == "begins_with" {
+			return strings.HasPrefix(*left.S, aws.StringValue(right.S)), nil
+		}
+		return strings.Contains(*left.S, aws.StringValue(right.S)), nil
+	}
+	left, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+	op := p.next()
+	right, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+	if left == nil || right == nil {
+		return false, nil
+	}
+	c, comparable := compare(left, right)
+	if !comparable {
+		return op == "<>", nil
+	}
+	switch op {
+	case "=":
+		return c == 0, nil
+	case "<>":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("unknown comparator %q", op)
+}
+
+// A path, a :value or size(path). Missing attributes are nil.
+func (p *exprParser) operand() (*dynamodb.AttributeValue, error) {
+	t := p.next()
+	switch {
+	case strings.HasPrefix(t, ":"):
+		v, found := p.values[t]
+		if !found {
+			return nil, fmt.Errorf("no value for %v", t)
+		}
+		return v, nil
+	case t == "size":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		v := p.item[p.name(p.next())]
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, nil
+		}
+		n := len(v.L) + len(v.M) + len(v.SS) + len(v.NS) + len(aws.StringValue(v.S))
+		return &dynamodb.AttributeValue{N: aws.String(fmt.Sprint(n))}, nil
+	}
+	return p.item[p.name(t)], nil
+}
+
+func compare(a, b *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case a.N != nil && b.N != nil:
+		x, _ := new(big.Float).SetString(*a.N)
+		y, _ := new(big.Float).SetString(*b.N)
+		return x.Cmp(y), true
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.BOOL != nil && b.BOOL != nil:
+		if *a.BOOL == *b.BOOL {
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func applyUpdate(expr string, item map[string]*dynamodb.AttributeValue, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	p := &exprParser{tokens: tokenize(expr), item: item, names: names, values: values}
+	for p.peek() != "" {
+		switch action := strings.ToUpper(p.next()); action {
+		case "SET":
+			for {
+				attr := p.name(p.next())
+				if err := p.expect("="); err != nil {
+					return err
+				}
+				v, err := p.setValue()
+				if err != nil {
+					return err
+				}
+				item[attr] = v
+				if p.peek() != "," {
+					break
+				}
+				p.next()
+			}
+		case "REMOVE":
+			for {
+				delete(item, p.name(p.next()))
+				if p.peek() != "," {
+					break
+				}
+				p.next()
+			}
+		case "ADD", "DELETE":
+			attr := p.name(p.next())
+			v, err := p.operand()
+			if err != nil {
+				return err
+			}
+			cur := item[attr]
+			switch {
+			case v.N != nil:
+				sum, _ := new(big.Float).SetString(*v.N)
+				if action == "ADD" && cur != nil && cur.N != nil {
+					x, _ := new(big.Float).SetString(*cur.N)
+					sum.Add(sum, x)
+				}
+				item[attr] = &dynamodb.AttributeValue{N: aws.String(sum.Text('f', -1))}
+			case v.SS != nil:
+				set := map[string]bool{}
+				if cur != nil {
+					for _, s := range cur.SS {
+						set[*s] = true
+					}
+				}
+				for _, s := range v.SS {
+					set[*s] = action == "ADD"
+				}
+				ss := []*string{}
+				for s, in := range set {
+					if in {
+						ss = append(ss, aws.String(s))
+					}
+				}
+				if len(ss) == 0 {
+					delete(item, attr)
+				} else {
+					item[attr] = &dynamodb.AttributeValue{SS: ss}
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported update action %q", action)
+		}
+	}
+	return nil
+}
+
+// The right hand side of a SET: an operand, list_append or if_not_exists
+func (p *exprParser) setValue() (*dynamodb.AttributeValue, error) {
+	switch p.peek() {
+	case "list_append", "if_not_exists":
+		fn := p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		a, err := p.setValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		b, err := p.setValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if fn == "if_not_exists" {
+			if a != nil {
+				return a, nil
+			}
+			return b, nil
+		}
+		list := []*dynamodb.AttributeValue{}
+		if a != nil {
+			list = append(list, a.L...)
+		}
+		return &dynamodb.AttributeValue{L: append(list, b.L...)}, nil
+	}
+	return p.operand()
+}
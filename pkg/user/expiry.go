@@ -0,0 +1,288 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/jordan-wright/email"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultExpiryNotice = 72 * time.Hour
+	defaultGrantNotice  = 15 * time.Minute
+)
+
+// Extra routes a user has until a point in time
+type Grant struct {
+	Routes string
+	Until  int64
+	By     string
+}
+
+// Marks a notice as sent so it goes out once
+type noticeRecord struct {
+	Pubkey  string
+	Expires int64
+}
+
+// Whether the account's expiry has passed
+func (u User) Expired(now time.Time) bool {
+	return u.ExpiresAt > 0 && now.Unix() >= u.ExpiresAt
+}
+
+// Read --expires (a date, or an RFC 3339 time) or --ttl (a duration) into a
+// unix time, 0 when neither is set
+func parseExpiry(vars *util.CmdVars) (int64, error) {
+	switch {
+	case vars.Expires != "" && vars.TTL != "":
+		return 0, errors.New("use either --expires or --ttl")
+	case vars.TTL != "":
+		ttl, err := time.ParseDuration(vars.TTL)
+		if err != nil || ttl <= 0 {
+			return 0, fmt.Errorf("--ttl must be a positive duration such as 72h")
+		}
+		return time.Now().Add(ttl).Unix(), nil
+	case vars.Expires != "":
+		if t, err := time.Parse(time.RFC3339, vars.Expires); err == nil {
+			return t.Unix(), nil
+		}
+		// A date means access through the end of that day
+		day, err := time.ParseInLocation("2006-01-02", vars.Expires, time.Local)
+		if err != nil {
+			return 0, fmt.Errorf("--expires must be a date such as 2026-12-31 or an RFC 3339 time")
+		}
+		return day.AddDate(0, 0, 1).Unix(), nil
+	}
+	return 0, nil
+}
+
+// Give a user extra routes for a limited time
+func AddGrant(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("grant", vars.ProfileName, ok, vars.Routes+" for "+vars.For) }()
+	duration, err := time.ParseDuration(vars.For)
+	if err != nil || duration <= 0 {
+		log.Error().Msg("--for must be a positive duration such as 4h")
+		return false
+	}
+	user, err := getUser(vars, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+
+	grant := Grant{
+		Routes: strings.Replace(vars.Routes, " ", "", -1),
+		Until:  time.Now().Add(duration).Unix(),
+		By:     audit.Actor(),
+	}
+	av, err := dynamodbattribute.MarshalMap(grant)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode grant")
+		return false
+	}
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(user.Pubkey),
+			},
+		},
+		UpdateExpression:    aws.String("set Grants = list_append(if_not_exists(Grants, :none), :grant)"),
+		ConditionExpression: aws.String("attribute_exists(Pubkey)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":none": {
+				L: []*dynamodb.AttributeValue{},
+			},
+			":grant": {
+				L: []*dynamodb.AttributeValue{{M: av}},
+			},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to store grant")
+		return false
+	}
+	log.Info().Msgf("%v granted %v until %v", vars.ProfileName, grant.Routes, time.Unix(grant.Until, 0).Format(time.RFC3339))
+	if user.Splittunnel {
+		log.Warn().Msg("Split tunnel clients only send the networks in their config over the VPN")
+	}
+	return true
+}
+
+// Grants still in effect
+func activeGrants(user User, now time.Time) []Grant {
+	active := []Grant{}
+	for _, v := range user.Grants {
+		if now.Unix() < v.Until {
+			active = append(active, v)
+		}
+	}
+	return active
+}
+
+// The routes to enforce now: the user's routes plus any active grants
+func activeRoutes(user User, cfg server.Config) string {
+	routes := []string{}
+	if base := userRoutes(user, cfg); base != "" {
+		routes = append(routes, base)
+	}
+	for _, v := range activeGrants(user, time.Now()) {
+		routes = append(routes, v.Routes)
+	}
+	return strings.Join(routes, ",")
+}
+
+// Users whose account has not expired
+func unexpired(users []User, now time.Time) []User {
+	active := []User{}
+	for _, v := range users {
+		if !v.Expired(now) {
+			active = append(active, v)
+		}
+	}
+	return active
+}
+
+// Leader task: warn users and admins ahead of account and grant expiry,
+// record expiries, and drop grants that have ended from the records
+func expireAccess(svc *dynamodb.DynamoDB) error {
+	users, err := scanUsers(svc)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	accountNotice := noticeLead("expiry.notifyBefore", defaultExpiryNotice)
+	grantNotice := noticeLead("expiry.grantNotifyBefore", defaultGrantNotice)
+
+	for _, v := range users {
+		if v.ReplacedBy != "" || v.Disabled() {
+			continue
+		}
+		if v.ExpiresAt > 0 {
+			until := time.Unix(v.ExpiresAt, 0)
+			switch {
+			case v.Expired(now):
+				if once(stateKey("notice", v.Pubkey, "expired"), 0, svc) {
+					log.Info().Msgf("Access for %v expired", v.ProfileName)
+					audit.Admin("expire", v.ProfileName, true, "")
+					notifyExpiry(v, "Wireguard VPN access expired",
+						"VPN access for "+v.ProfileName+" expired at "+until.Format(time.RFC1123)+".")
+				}
+			case until.Sub(now) <= accountNotice:
+				if once(stateKey("notice", v.Pubkey, "expiring", fmt.Sprint(v.ExpiresAt)), v.ExpiresAt, svc) {
+					notifyExpiry(v, "Wireguard VPN access expiring",
+						"VPN access for "+v.ProfileName+" expires at "+until.Format(time.RFC1123)+". Ask an administrator if you still need it.")
+				}
+			}
+		}
+
+		ended := false
+		for _, g := range v.Grants {
+			until := time.Unix(g.Until, 0)
+			if now.After(until) {
+				ended = true
+				continue
+			}
+			if until.Sub(now) <= grantNotice && once(stateKey("notice", v.Pubkey, "grant", fmt.Sprint(g.Until)), g.Until, svc) {
+				notifyExpiry(v, "Wireguard VPN temporary access ending",
+					"Temporary access for "+v.ProfileName+" to "+g.Routes+" ends at "+until.Format(time.RFC1123)+".")
+			}
+		}
+		if ended {
+			if err := setGrants(v, len(v.Grants), activeGrants(v, now), svc); err != nil {
+				return err
+			}
+			audit.Admin("grant-expired", v.ProfileName, true, "")
+		}
+	}
+	return nil
+}
+
+func noticeLead(key string, fallback time.Duration) time.Duration {
+	if lead := viper.GetInt(key); lead > 0 {
+		return time.Second * time.Duration(lead)
+	}
+	return fallback
+}
+
+// Claim a notice so it is only sent once. A zero expiry keeps the claim
+// until the user's state is removed.
+func once(key string, expires int64, svc *dynamodb.DynamoDB) bool {
+	condition := "attribute_not_exists(Pubkey) OR Expires <= :now"
+	// Expires <= :now holds for 0, which would make the claim free every time
+	if expires == 0 {
+		condition = "attribute_not_exists(Pubkey)"
+	}
+	claimed, err := putStateIf(noticeRecord{Pubkey: key, Expires: expires}, condition, nil, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to record notice")
+		return false
+	}
+	return claimed
+}
+
+// Email the user and expiry.notifyAdmins
+func notifyExpiry(user User, subject string, body string) {
+	log.Info().Msgf("%v: %v", subject, user.ProfileName)
+	if !viper.GetBool("smtp.enabled") {
+		return
+	}
+	if err := SendNotice(user, subject, body); err != nil {
+		log.Error().Err(err).Msgf("Unable to notify %v", user.Email)
+	}
+	admins := viper.GetStringSlice("expiry.notifyAdmins")
+	if len(admins) == 0 {
+		return
+	}
+	e := email.NewEmail()
+	e.From = viper.GetString("smtp.from")
+	e.To = admins
+	e.Subject = subject + " [" + user.ProfileName + "]"
+	e.Text = []byte(body + "\n\nUser: " + user.Email)
+	if err := deliver(e); err != nil {
+		log.Error().Err(err).Msg("Unable to notify admins")
+	}
+}
+
+// Replace the user's grants, unless a grant was added since they were read
+func setGrants(user User, read int, grants []Grant, svc *dynamodb.DynamoDB) error {
+	av, err := dynamodbattribute.MarshalList(grants)
+	if err != nil {
+		return err
+	}
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(user.Pubkey),
+			},
+		},
+		UpdateExpression:    aws.String("set Grants = :grants"),
+		ConditionExpression: aws.String("attribute_exists(Pubkey) AND size(Grants) = :read"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":grants": {
+				L: av,
+			},
+			":read": {
+				N: aws.String(strconv.Itoa(read)),
+			},
+		},
+	})
+	// Tried again on the next run
+	if conditionFailed(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnce(t *testing.T) {
+	_, svc := newFakeTable(t)
+	tests := []struct {
+		name    string
+		key     string
+		expires int64
+	}{
+		{"never expires", stateKey("notice", "key", "expired"), 0},
+		{"expires later", stateKey("notice", "key", "expiring", "1"), time.Now().Add(time.Hour).Unix()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !once(tt.key, tt.expires, svc) {
+				t.Fatal("first claim failed")
+			}
+			if once(tt.key, tt.expires, svc) {
+				t.Fatal("second claim succeeded")
+			}
+		})
+	}
+
+	// A lapsed claim can be taken again
+	key := stateKey("notice", "key", "grant", "1")
+	past := time.Now().Add(-time.Minute).Unix()
+	if !once(key, past, svc) || !once(key, past, svc) {
+		t.Fatal("lapsed claim was not released")
+	}
+}
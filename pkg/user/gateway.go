@@ -0,0 +1,258 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Lease held by the gateway that runs the singleton sync tasks
+const leaderLease = "sync-leader"
+
+// What one gateway reported for one server on its last sync
+type gatewayRecord struct {
+	Pubkey  string
+	Gateway string
+	Server  string
+	Updated int64
+	Expires int64
+	Peers   []connectedPeer
+}
+
+type connectedPeer struct {
+	Pubkey        string
+	Endpoint      string
+	LastHandshake int64
+}
+
+// Seconds since the last handshake for a peer to count as connected
+func handshakeWindow() time.Duration {
+	window := time.Second * time.Duration(viper.GetInt("metrics.handshakeWindow"))
+	if window <= 0 {
+		window = 3 * time.Minute
+	}
+	return window
+}
+
+// Time before an unrenewed leader lease or gateway record lapses
+func leaseTTL() time.Duration {
+	if ttl := viper.GetInt("ha.leaseTtl"); ttl > 0 {
+		return time.Second * time.Duration(ttl)
+	}
+	interval := time.Second * time.Duration(viper.GetInt("syncInterval"))
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return 3 * interval
+}
+
+// Publish which peers are connected to this gateway. The record lapses when
+// the gateway stops syncing.
+func reportGateway(serverName string, peers []wgtypes.Peer, svc *dynamodb.DynamoDB) error {
+	now := time.Now()
+	record := gatewayRecord{
+		Pubkey:  stateKey("gateway", gatewayID(), serverName),
+		Gateway: gatewayID(),
+		Server:  serverName,
+		Updated: now.Unix(),
+		Expires: now.Add(leaseTTL()).Unix(),
+		Peers:   []connectedPeer{},
+	}
+	window := handshakeWindow()
+	for _, v := range peers {
+		if now.Sub(v.LastHandshakeTime) >= window {
+			continue
+		}
+		peer := connectedPeer{
+			Pubkey:        v.PublicKey.String(),
+			LastHandshake: v.LastHandshakeTime.Unix(),
+		}
+		if v.Endpoint != nil {
+			peer.Endpoint = v.Endpoint.String()
+		}
+		record.Peers = append(record.Peers, peer)
+	}
+	return putState(record, svc)
+}
+
+// Show every gateway that synced recently and the peers connected to it
+func Gateways(svc *dynamodb.DynamoDB) bool {
+	records := []gatewayRecord{}
+	if err := scanState(stateKey("gateway", ""), &records, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to read gateway status")
+		return false
+	}
+	if len(records) == 0 {
+		log.Error().Msg("No gateway has reported in")
+		return true
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Pubkey < records[j].Pubkey
+	})
+	leader, err := leaseHolder(leaderLease, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read the leader lease")
+	}
+	profiles := usersMap(scan(false, svc))
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Gateway\tServer\tLast sync\tConnected\tPeers")
+	for _, v := range records {
+		name := v.Gateway
+		if name == leader {
+			name += " (leader)"
+		}
+		peers := []string{}
+		for _, p := range v.Peers {
+			profile := profiles[p.Pubkey].ProfileName
+			if profile == "" {
+				profile = p.Pubkey
+			}
+			peers = append(peers, profile+"@"+p.Endpoint)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%d\t%v\n", name, v.Server, time.Unix(v.Updated, 0).Format(time.RFC3339), len(v.Peers), strings.Join(peers, ", "))
+	}
+	w.Flush()
+	return true
+}
+
+// Elects one gateway to run the tasks that must not run everywhere at once
+type leader struct {
+	svc  *dynamodb.DynamoDB
+	held bool
+}
+
+// Try for the leader lease every sync interval until ctx is done, running
+// the singleton tasks while it is held
+func (l *leader) loop(ctx context.Context) {
+	for {
+		configMu.RLock()
+		l.tick()
+		interval := time.Second * time.Duration(viper.GetInt("syncInterval"))
+		configMu.RUnlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if l.held {
+				if err := releaseLease(leaderLease, gatewayID(), l.svc); err != nil {
+					log.Error().Err(err).Msg("Unable to release the leader lease")
+				}
+			}
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *leader) tick() {
+	held, err := acquireLease(leaderLease, gatewayID(), leaseTTL(), l.svc)
+	if err != nil {
+		// Without the store nobody can confirm the lease, so assume it lapsed
+		log.Error().Err(err).Msg("Unable to renew the leader lease")
+		held = false
+	}
+	if held != l.held {
+		if held {
+			log.Info().Msgf("Gateway %v is now the sync leader", gatewayID())
+		} else {
+			log.Info().Msgf("Gateway %v is no longer the sync leader", gatewayID())
+		}
+		l.held = held
+	}
+	if !held {
+		return
+	}
+	for _, task := range leaderTasks {
+		if err := task.run(l.svc); err != nil {
+			log.Error().Err(err).Msgf("Leader task %v failed", task.name)
+		}
+	}
+}
+
+type leaderTask struct {
+	name string
+	run  func(*dynamodb.DynamoDB) error
+}
+
+// Tasks only the leader runs, in order, once per sync interval
+var leaderTasks = []leaderTask{
+	{"prune-state", pruneOrphanState},
+	{"retire-keys", retireKeys},
+	{"rotate-aged-keys", rotateAgedKeys},
+	{"deliver-server-keys", deliverServerKeys},
+	{"expire-access", expireAccess},
+	{"reconcile-idp", reconcileIdp},
+}
+
+// Remove per user state left behind by users that are no longer in the table
+func pruneOrphanState(svc *dynamodb.DynamoDB) error {
+	// Keys first, so state of a user added meanwhile is never taken for an orphan
+	keys := []string{}
+	err := svc.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(viper.GetString("dynamoDBTable")),
+		FilterExpression:     aws.String("contains(Pubkey, :sep)"),
+		ProjectionExpression: aws.String("Pubkey"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sep": {
+				S: aws.String(stateSep),
+			},
+		},
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			keys = append(keys, aws.StringValue(item["Pubkey"].S))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	users, err := scanUsers(svc)
+	if err != nil {
+		return err
+	}
+	known := usersMap(users)
+
+	pruned := 0
+	for _, key := range keys {
+		owner := stateOwner(key)
+		if owner == "" {
+			continue
+		}
+		if _, found := known[owner]; found {
+			continue
+		}
+		if err := deleteState(key, svc); err != nil {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Info().Msgf("Removed %d state records of deleted users", pruned)
+	}
+	return nil
+}
+
+// The public key a per user state record belongs to, empty for shared records
+func stateOwner(key string) string {
+	parts := strings.Split(key, stateSep)
+	switch {
+	case len(parts) >= 2 && (parts[0] == "grace" || parts[0] == "lastauth" || parts[0] == "failures" || parts[0] == "lockout" || parts[0] == "notice"):
+		return parts[1]
+	case len(parts) >= 3 && parts[0] == "rate" && parts[1] == "key":
+		return parts[2]
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package user
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/geo"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// A remembered device: a successful MFA from this pubkey and source
+type graceRecord struct {
+	Pubkey  string
+	Owner   string
+	Source  string
+	Serial  int
+	Expires int64
+}
+
+// The grace window, zero when disabled
+func gracePeriod() time.Duration {
+	return time.Second * time.Duration(viper.GetInt("grace.period"))
+}
+
+// Identify where a connection comes from, either the IP or its ASN
+func graceSource(ip net.IP) string {
+	if viper.GetBool("grace.matchASN") {
+		if asn, _, ok := geo.ASN(ip); ok {
+			return geo.FormatASN(asn)
+		}
+	}
+	return ip.String()
+}
+
+// Check whether the user recently passed MFA from the same source
+func InGrace(user User, ip net.IP, svc *dynamodb.DynamoDB) bool {
+	if gracePeriod() <= 0 || ip == nil {
+		return false
+	}
+	record := graceRecord{}
+	found, err := getState(stateKey("grace", user.Pubkey, graceSource(ip)), &record, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read grace record")
+		return false
+	}
+	// A route change bumps the serial and ends the grace window
+	return found && record.Serial == user.Serial
+}
+
+// Remember a successful MFA for the grace window
+func Remember(user User, ip net.IP, svc *dynamodb.DynamoDB) {
+	if gracePeriod() <= 0 || ip == nil {
+		return
+	}
+	source := graceSource(ip)
+	record := graceRecord{
+		Pubkey:  stateKey("grace", user.Pubkey, source),
+		Owner:   user.Pubkey,
+		Source:  source,
+		Serial:  user.Serial,
+		Expires: time.Now().Add(gracePeriod()).Unix(),
+	}
+	if err := putState(record, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to store grace record")
+	}
+}
+
+// Forget every remembered source for a user
+func RevokeGrace(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("revoke-grace", vars.ProfileName, ok, "") }()
+	user, err := getUser(vars, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+	n, err := deleteStatePrefix(stateKey("grace", user.Pubkey), svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to revoke grace records")
+		return false
+	}
+	log.Info().Msg(strconv.Itoa(n) + " remembered sources revoked for " + vars.ProfileName)
+	return true
+}
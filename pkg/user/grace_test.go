@@ -0,0 +1,70 @@
+package user
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+)
+
+func TestInGrace(t *testing.T) {
+	table, svc := newFakeTable(t)
+	configure(t, map[string]interface{}{"grace.period": 600})
+	alice := User{Pubkey: "alice=", ProfileName: "alice-laptop", Serial: 4}
+	table.put(t, alice)
+	table.put(t, nameRecord{Pubkey: nameKey("alice-laptop"), Owner: "alice="})
+	home := net.ParseIP("198.51.100.7")
+	cafe := net.ParseIP("203.0.113.9")
+
+	if InGrace(alice, home, svc) {
+		t.Fatal("in grace before any MFA")
+	}
+	Remember(alice, home, svc)
+	Remember(alice, cafe, svc)
+
+	routesChanged := alice
+	routesChanged.Serial++
+	rotated := alice
+	rotated.Pubkey = "alice-next="
+	tests := []struct {
+		name string
+		user User
+		ip   net.IP
+		want bool
+	}{
+		{"same source", alice, home, true},
+		{"other source", alice, net.ParseIP("192.0.2.1"), false},
+		{"unknown source", alice, nil, false},
+		{"routes changed", routesChanged, home, false},
+		{"key rotated", rotated, home, false},
+	}
+	for _, tt := range tests {
+		if got := InGrace(tt.user, tt.ip, svc); got != tt.want {
+			t.Errorf("%v: in grace %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The window ends with the record, before TTL removes it
+	table.put(t, graceRecord{Pubkey: stateKey("grace", "alice=", "203.0.113.9"), Owner: "alice=", Source: "203.0.113.9", Serial: 4, Expires: time.Now().Add(-time.Second).Unix()})
+	if InGrace(alice, cafe, svc) {
+		t.Error("in grace after the window ended")
+	}
+
+	if !RevokeGrace(&util.CmdVars{ProfileName: "alice-laptop"}, svc) {
+		t.Fatal("revoke failed")
+	}
+	if InGrace(alice, home, svc) {
+		t.Error("in grace after revoke")
+	}
+}
+
+func TestGraceDisabled(t *testing.T) {
+	_, svc := newFakeTable(t)
+	alice := User{Pubkey: "alice="}
+	home := net.ParseIP("198.51.100.7")
+	Remember(alice, home, svc)
+	if InGrace(alice, home, svc) {
+		t.Error("in grace with grace.period unset")
+	}
+}
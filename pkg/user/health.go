@@ -0,0 +1,136 @@
+package user
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Sync health reported on /healthz and /readyz
+type syncStatus struct {
+	mu sync.Mutex
+	syncReport
+}
+
+type syncReport struct {
+	Started             time.Time `json:"started"`
+	LastSync            time.Time `json:"lastSync"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	StoreReachable      bool      `json:"storeReachable"`
+	InterfacePresent    bool      `json:"interfacePresent"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+// Status of every server being synced, by name
+type statusSet struct {
+	mu     sync.Mutex
+	byName map[string]*syncStatus
+}
+
+var statuses = &statusSet{byName: map[string]*syncStatus{}}
+
+// Start tracking a server
+func (s *statusSet) add(name string) *syncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &syncStatus{syncReport: syncReport{Started: time.Now()}}
+	s.byName[name] = status
+	return status
+}
+
+// Reports for every server. Live and ready only when every server is.
+func (s *statusSet) snapshot() (map[string]syncReport, bool, bool) {
+	// Read the config first: configMu must never be taken while a status
+	// lock is held, because the sync loop takes them the other way round
+	limits := currentLimits()
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := map[string]syncReport{}
+	live, ready := len(s.byName) > 0, len(s.byName) > 0
+	for name, status := range s.byName {
+		report, l, r := status.snapshot(limits, now)
+		reports[name] = report
+		live = live && l
+		ready = ready && r
+	}
+	return reports, live, ready
+}
+
+// Sync timing the live/ready verdicts are judged against
+type healthLimits struct {
+	interval time.Duration
+	// Failed syncs tolerated before a server is no longer ready
+	tolerance int
+}
+
+func currentLimits() healthLimits {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	limits := healthLimits{
+		interval:  time.Second * time.Duration(viper.GetInt("syncInterval")),
+		tolerance: viper.GetInt("syncMaxFailures"),
+	}
+	if limits.interval <= 0 {
+		limits.interval = time.Minute
+	}
+	if limits.tolerance <= 0 {
+		limits.tolerance = 3
+	}
+	return limits
+}
+
+func (s *syncStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastSync = time.Now()
+	if err != nil {
+		s.ConsecutiveFailures++
+		s.LastError = err.Error()
+		return
+	}
+	s.LastSuccess = s.LastSync
+	s.ConsecutiveFailures = 0
+	s.LastError = ""
+}
+
+func (s *syncStatus) setStore(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.StoreReachable = ok
+}
+
+func (s *syncStatus) setInterface(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.InterfacePresent = ok
+}
+
+func (s *syncStatus) failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ConsecutiveFailures
+}
+
+// Copy of the current status with the live/ready verdicts
+func (s *syncStatus) snapshot(limits healthLimits, now time.Time) (syncReport, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.syncReport
+
+	// Live while the loop keeps turning, whether or not iterations succeed
+	last := s.LastSync
+	if last.IsZero() {
+		last = s.Started
+	}
+	live := now.Sub(last) < 3*limits.interval
+
+	// Ready once a sync succeeded recently enough and while the interface
+	// exists. An unreachable store is tolerated like any failed sync, since
+	// peers already configured keep working.
+	ready := !s.LastSuccess.IsZero() && now.Sub(s.LastSuccess) < time.Duration(limits.tolerance+1)*limits.interval && s.InterfacePresent
+	return snap, live, ready
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncStatusSnapshot(t *testing.T) {
+	limits := healthLimits{interval: time.Minute, tolerance: 3}
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	healthy := syncReport{Started: ago(time.Hour), LastSync: ago(30 * time.Second), LastSuccess: ago(30 * time.Second), StoreReachable: true, InterfacePresent: true}
+	with := func(change func(r *syncReport)) syncReport {
+		r := healthy
+		change(&r)
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		report syncReport
+		live   bool
+		ready  bool
+	}{
+		{"healthy", healthy, true, true},
+		{"starting", syncReport{Started: ago(time.Second)}, true, false},
+		{"first sync never finished", syncReport{Started: ago(5 * time.Minute)}, false, false},
+		{"loop stalled", with(func(r *syncReport) { r.LastSync, r.LastSuccess = ago(10*time.Minute), ago(10*time.Minute) }), false, false},
+		{"failing within tolerance", with(func(r *syncReport) { r.LastSuccess, r.ConsecutiveFailures = ago(3*time.Minute), 3 }), true, true},
+		{"failing past tolerance", with(func(r *syncReport) { r.LastSuccess, r.ConsecutiveFailures = ago(5*time.Minute), 5 }), true, false},
+		{"store down briefly", with(func(r *syncReport) { r.StoreReachable, r.LastSuccess = false, ago(2*time.Minute) }), true, true},
+		{"store down past tolerance", with(func(r *syncReport) { r.StoreReachable, r.LastSuccess = false, ago(5*time.Minute) }), true, false},
+		{"interface down", with(func(r *syncReport) { r.InterfacePresent = false }), true, false},
+	}
+	for _, tt := range tests {
+		status := &syncStatus{syncReport: tt.report}
+		_, live, ready := status.snapshot(limits, now)
+		if live != tt.live || ready != tt.ready {
+			t.Errorf("%v: live %v ready %v, want %v %v", tt.name, live, ready, tt.live, tt.ready)
+		}
+	}
+}
+
+func TestStatusSet(t *testing.T) {
+	set := &statusSet{byName: map[string]*syncStatus{}}
+	if _, live, ready := set.snapshot(); live || ready {
+		t.Error("live or ready with no servers")
+	}
+	engineering := set.add("engineering")
+	contractors := set.add("contractors")
+	for _, s := range []*syncStatus{engineering, contractors} {
+		s.setStore(true)
+		s.setInterface(true)
+		s.record(nil)
+	}
+	if _, live, ready := set.snapshot(); !live || !ready {
+		t.Errorf("live %v ready %v with every server synced", live, ready)
+	}
+
+	contractors.setInterface(false)
+	contractors.record(errors.New("getting wireguard device"))
+	reports, live, ready := set.snapshot()
+	if !live || ready {
+		t.Errorf("live %v ready %v with one interface missing, want live only", live, ready)
+	}
+	if reports["contractors"].ConsecutiveFailures != 1 || reports["contractors"].LastError == "" {
+		t.Errorf("failure not reported: %+v", reports["contractors"])
+	}
+}
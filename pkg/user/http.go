@@ -0,0 +1,38 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Serve the sync daemon's HTTP endpoints
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		reports, live, _ := statuses.snapshot()
+		writeStatus(w, reports, live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		reports, _, ready := statuses.snapshot()
+		writeStatus(w, reports, ready)
+	})
+
+	log.Info().Msgf("Listening on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error().Err(err).Msg("HTTP listener failed")
+	}
+}
+
+// Reports are keyed by server name
+func writeStatus(w http.ResponseWriter, reports map[string]syncReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,288 @@
+package user
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/okta"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// The person behind one or more devices. Each device is a User record with
+// its own key and address; they are tied to the identity by email.
+type Identity struct {
+	Pubkey     string
+	Email      string
+	OktaUserId string
+	Groups     []string
+	// Current public keys of the identity's devices
+	Devices []string `dynamodbav:",stringset,omitempty"`
+	// Devices allowed for this identity, 0 uses devices.maxPerUser
+	MaxDevices int
+	Created    int64
+}
+
+func identityKey(email string) string {
+	return stateKey("identity", strings.ToLower(email))
+}
+
+func getIdentity(email string, svc *dynamodb.DynamoDB) (Identity, bool, error) {
+	identity := Identity{}
+	found, err := getState(identityKey(email), &identity, svc)
+	return identity, found, err
+}
+
+// Create the identity record for an email if there is none yet
+func ensureIdentity(email string, svc *dynamodb.DynamoDB) error {
+	_, err := putStateIfAbsent(Identity{
+		Pubkey:  identityKey(email),
+		Email:   email,
+		Created: time.Now().Unix(),
+	}, svc)
+	return err
+}
+
+// Devices allowed for an identity, 0 for no limit
+func deviceLimit(identity Identity) int {
+	if identity.MaxDevices > 0 {
+		return identity.MaxDevices
+	}
+	return viper.GetInt("devices.maxPerUser")
+}
+
+// The current keys of an identity, from its Devices set or, for identities
+// from before the index, by email. Keys retiring after a rotation belong to
+// a device already counted.
+func devicesOf(identity Identity, users []User) []User {
+	devices := []User{}
+	if len(identity.Devices) > 0 {
+		byKey := usersMap(users)
+		for _, key := range identity.Devices {
+			if v, found := byKey[key]; found {
+				devices = append(devices, v)
+			}
+		}
+		return devices
+	}
+	for _, v := range users {
+		if strings.EqualFold(v.Email, identity.Email) && v.ReplacedBy == "" {
+			devices = append(devices, v)
+		}
+	}
+	return devices
+}
+
+// Write a new device and add it to its identity's Devices set in one
+// transaction. The condition on the identity holds the device limit against
+// concurrent adds from any server.
+func addDeviceRecord(user User, svc *dynamodb.DynamoDB) error {
+	identity, _, err := getIdentity(user.Email, svc)
+	if err != nil {
+		return err
+	}
+	av, err := dynamodbattribute.MarshalMap(user)
+	if err != nil {
+		return err
+	}
+	condition := "attribute_exists(Pubkey)"
+	values := map[string]*dynamodb.AttributeValue{
+		":keys": {
+			SS: []*string{aws.String(user.Pubkey)},
+		},
+	}
+	limit := deviceLimit(identity)
+	if limit > 0 {
+		condition += " AND (attribute_not_exists(Devices) OR size(Devices) < :max)"
+		values[":max"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(limit))}
+	}
+	table := aws.String(viper.GetString("dynamoDBTable"))
+	_, err = svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Update: &dynamodb.Update{
+					TableName: table,
+					Key: map[string]*dynamodb.AttributeValue{
+						"Pubkey": {
+							S: aws.String(identityKey(user.Email)),
+						},
+					},
+					UpdateExpression:          aws.String("ADD Devices :keys"),
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeValues: values,
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName:           table,
+					Item:                av,
+					ConditionExpression: aws.String("attribute_not_exists(Pubkey)"),
+				},
+			},
+		},
+	})
+	if transactionConflict(err, 0) {
+		return fmt.Errorf("%v already has the %d devices allowed", user.Email, limit)
+	}
+	return err
+}
+
+// List identities with their devices. Users added before identities were
+// recorded show up by email.
+func Identities(svc *dynamodb.DynamoDB) bool {
+	users, err := scanUsers(svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read users")
+		return false
+	}
+	records := []Identity{}
+	if err := scanState(stateKey("identity", ""), &records, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to read identities")
+		return false
+	}
+	byEmail := map[string]Identity{}
+	for _, v := range records {
+		byEmail[strings.ToLower(v.Email)] = v
+	}
+	for _, v := range users {
+		if _, found := byEmail[strings.ToLower(v.Email)]; !found {
+			byEmail[strings.ToLower(v.Email)] = Identity{Email: v.Email}
+		}
+	}
+	emails := []string{}
+	for k := range byEmail {
+		emails = append(emails, k)
+	}
+	sort.Strings(emails)
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Email\tOkta ID\tGroups\tDevices\tProfiles")
+	for _, k := range emails {
+		identity := byEmail[k]
+		devices := devicesOf(identity, users)
+		names := []string{}
+		for _, d := range devices {
+			names = append(names, d.ProfileName)
+		}
+		count := strconv.Itoa(len(devices))
+		if limit := deviceLimit(identity); limit > 0 {
+			count += "/" + strconv.Itoa(limit)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", identity.Email, identity.OktaUserId, strings.Join(identity.Groups, ","), count, strings.Join(names, ", "))
+	}
+	w.Flush()
+	return true
+}
+
+// Remove an identity and every device registered to it
+func RemoveIdentity(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("remove-identity", "", ok, vars.Email) }()
+	// Retiring keys go too
+	records, err := recordsOf(vars.Email, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read users")
+		return false
+	}
+	ok = true
+	removed := 0
+	for _, v := range records {
+		if !deleteRecord(v, svc) {
+			ok = false
+			continue
+		}
+		deleteUserState(v.Pubkey, svc)
+		if err := releaseName(v.ProfileName, v.Pubkey, svc); err != nil {
+			log.Error().Err(err).Msg("Unable to release profile name")
+		}
+		audit.Admin("remove", v.ProfileName, true, "identity "+vars.Email)
+		removed++
+	}
+	if !ok {
+		log.Error().Msgf("Some devices of %v could not be removed, keeping the identity", vars.Email)
+		return false
+	}
+	if err := deleteState(identityKey(vars.Email), svc); err != nil {
+		log.Error().Err(err).Msg("Unable to remove identity")
+		return false
+	}
+	log.Info().Msgf("%v and %d devices succesfully removed", vars.Email, removed)
+	return true
+}
+
+// Set how many devices an identity may have, 0 to fall back to the default
+func SetDeviceLimit(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("set-device-limit", "", ok, vars.Email+" "+strconv.Itoa(vars.MaxDevices)) }()
+	if err := ensureIdentity(vars.Email, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to create identity")
+		return false
+	}
+	_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(identityKey(vars.Email)),
+			},
+		},
+		UpdateExpression: aws.String("set MaxDevices = :max"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":max": {
+				N: aws.String(strconv.Itoa(vars.MaxDevices)),
+			},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to set device limit")
+		return false
+	}
+	log.Info().Msgf("Device limit for %v set to %d", vars.Email, vars.MaxDevices)
+	return true
+}
+
+// Store the IdP linkage and group memberships on the user's identity
+func linkIdentity(email string, oktaUserID string, svc *dynamodb.DynamoDB) error {
+	groups, err := okta.GetUserGroups(oktaUserID)
+	if err != nil {
+		return err
+	}
+	if err := ensureIdentity(email, svc); err != nil {
+		return err
+	}
+	groupList := []*dynamodb.AttributeValue{}
+	for _, v := range groups {
+		groupList = append(groupList, &dynamodb.AttributeValue{S: aws.String(v)})
+	}
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(identityKey(email)),
+			},
+		},
+		UpdateExpression: aws.String("set OktaUserId = :uid, #groups = :groups"),
+		// Aliased in case it collides with a reserved word, like Rule
+		ExpressionAttributeNames: map[string]*string{
+			"#groups": aws.String("Groups"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":uid": {
+				S: aws.String(oktaUserID),
+			},
+			":groups": {
+				L: groupList,
+			},
+		},
+	})
+	return err
+}
@@ -0,0 +1,48 @@
+package user
+
+import "testing"
+
+func TestAddDeviceRecord(t *testing.T) {
+	table, svc := newFakeTable(t)
+	configure(t, map[string]interface{}{"devices.maxPerUser": 2})
+	if err := ensureIdentity("alice@example.com", svc); err != nil {
+		t.Fatal(err)
+	}
+	add := func(pubkey string) error {
+		return addDeviceRecord(User{Pubkey: pubkey, ProfileName: "alice-" + pubkey, Email: "alice@example.com"}, svc)
+	}
+
+	for _, key := range []string{"a=", "b="} {
+		if err := add(key); err != nil {
+			t.Fatalf("adding %v: %v", key, err)
+		}
+	}
+	if err := add("c="); err == nil {
+		t.Fatal("added a device past the limit")
+	}
+	identity, _, _ := getIdentity("alice@example.com", svc)
+	if table.has("c=") || len(identity.Devices) != 2 {
+		t.Errorf("refused device was written: devices %v", identity.Devices)
+	}
+
+	// A per-identity limit replaces the default
+	table.put(t, Identity{Pubkey: identityKey("alice@example.com"), Email: "alice@example.com", Devices: identity.Devices, MaxDevices: 3})
+	if err := add("c="); err != nil {
+		t.Fatalf("per-identity limit: %v", err)
+	}
+	if err := add("d="); err == nil {
+		t.Error("added a device past the per-identity limit")
+	}
+
+	// No limit at all
+	configure(t, map[string]interface{}{"devices.maxPerUser": 0})
+	table.put(t, Identity{Pubkey: identityKey("bob@example.com"), Email: "bob@example.com"})
+	for _, key := range []string{"e=", "f=", "g="} {
+		if err := addDeviceRecord(User{Pubkey: key, Email: "bob@example.com"}, svc); err != nil {
+			t.Fatalf("adding %v without a limit: %v", key, err)
+		}
+	}
+	if identity, _, _ := getIdentity("bob@example.com", svc); len(identity.Devices) != 3 || !table.has("g=") {
+		t.Errorf("devices %v, want 3", identity.Devices)
+	}
+}
@@ -0,0 +1,77 @@
+package user
+
+import (
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/okta"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Re-resolve the Okta IDs for one profile, or every user when no profile is given
+func RefreshIdp(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+	users := []User{}
+	if vars.ProfileName != "" {
+		user, err := getUser(vars, svc)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to find user")
+			return false
+		}
+		users = append(users, user)
+	} else {
+		users = scan(false, svc)
+	}
+
+	ok := true
+	for _, v := range users {
+		if _, err := ResolveIdp(v, svc); err != nil {
+			log.Error().Err(err).Msgf("Unable to refresh Okta IDs for %v", v.ProfileName)
+			audit.Admin("refresh-idp", v.ProfileName, false, err.Error())
+			ok = false
+			continue
+		}
+		log.Info().Msgf("Okta IDs refreshed for %v", v.ProfileName)
+		audit.Admin("refresh-idp", v.ProfileName, true, "")
+	}
+	return ok
+}
+
+// Look up a user's Okta IDs and cache them on the record
+func ResolveIdp(user User, svc *dynamodb.DynamoDB) (User, error) {
+	userID, factorID, err := okta.ResolveIds(user.Email)
+	if err != nil {
+		return user, err
+	}
+	user.OktaUserId = userID
+	user.OktaFactorId = factorID
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":uid": {
+				S: aws.String(userID),
+			},
+			":fid": {
+				S: aws.String(factorID),
+			},
+		},
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(user.Pubkey),
+			},
+		},
+		UpdateExpression: aws.String("set OktaUserId = :uid, OktaFactorId = :fid"),
+	}
+
+	// A failed write only costs a lookup on the next auth
+	if _, err := svc.UpdateItem(input); err != nil {
+		log.Error().Err(err).Msg("Unable to cache Okta IDs")
+	}
+	if err := linkIdentity(user.Email, userID, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to update identity")
+	}
+	return user, nil
+}
@@ -0,0 +1,241 @@
+package user
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Profile names are claimed with a "name#<profile>" record pointing at the
+// current key, written only if no other key holds it. That keeps names
+// unique and turns profile lookups into a single read. Email lookups use the
+// Devices set on the identity record.
+type nameRecord struct {
+	Pubkey string
+	Owner  string
+}
+
+func nameKey(profile string) string {
+	return stateKey("name", profile)
+}
+
+// Claim a profile name for a key. Returns false when another key holds it.
+func claimName(profile string, pubkey string, svc *dynamodb.DynamoDB) (bool, error) {
+	return putStateIf(nameRecord{Pubkey: nameKey(profile), Owner: pubkey},
+		"attribute_not_exists(Pubkey) OR Owner = :owner",
+		map[string]*dynamodb.AttributeValue{
+			":owner": {
+				S: aws.String(pubkey),
+			},
+		}, svc)
+}
+
+// Point a profile name at a new key, as long as the old key still holds it
+func moveName(profile string, from string, to string, svc *dynamodb.DynamoDB) error {
+	moved, err := putStateIf(nameRecord{Pubkey: nameKey(profile), Owner: to},
+		"attribute_not_exists(Pubkey) OR Owner = :from",
+		map[string]*dynamodb.AttributeValue{
+			":from": {
+				S: aws.String(from),
+			},
+		}, svc)
+	if err == nil && !moved {
+		err = fmt.Errorf("profile %v is held by another key", profile)
+	}
+	return err
+}
+
+// Give up a profile name if the key still holds it
+func releaseName(profile string, pubkey string, svc *dynamodb.DynamoDB) error {
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(nameKey(profile)),
+			},
+		},
+		ConditionExpression: aws.String("Owner = :owner"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {
+				S: aws.String(pubkey),
+			},
+		},
+	})
+	if conditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// The key holding a profile name
+func lookupName(profile string, svc *dynamodb.DynamoDB) (string, bool, error) {
+	record := nameRecord{}
+	found, err := getState(nameKey(profile), &record, svc)
+	return record.Owner, found, err
+}
+
+// Add or drop a key in the identity's set of devices
+func addDevice(email string, pubkey string, svc *dynamodb.DynamoDB) error {
+	return updateDevices("ADD", email, pubkey, svc)
+}
+
+func removeDevice(email string, pubkey string, svc *dynamodb.DynamoDB) error {
+	return updateDevices("DELETE", email, pubkey, svc)
+}
+
+func updateDevices(op string, email string, pubkey string, svc *dynamodb.DynamoDB) error {
+	_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(identityKey(email)),
+			},
+		},
+		UpdateExpression: aws.String(op + " Devices :keys"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":keys": {
+				SS: []*string{aws.String(pubkey)},
+			},
+		},
+	})
+	return err
+}
+
+// The records registered to an email: its devices and any key still retiring
+// after a rotation. Read through the identity's Devices set; identities
+// without one, from before the index, are found by scanning.
+func recordsOf(email string, svc *dynamodb.DynamoDB) ([]User, error) {
+	identity, found, err := getIdentity(email, svc)
+	if err != nil {
+		return nil, err
+	}
+	if !found || len(identity.Devices) == 0 {
+		users, err := scanUsers(svc)
+		if err != nil {
+			return nil, err
+		}
+		records := []User{}
+		for _, v := range users {
+			if strings.EqualFold(v.Email, email) {
+				records = append(records, v)
+			}
+		}
+		return records, nil
+	}
+
+	records := []User{}
+	for _, key := range identity.Devices {
+		user := User{}
+		found, err := getState(key, &user, svc)
+		if err != nil {
+			return nil, err
+		}
+		// Removed since the set was read
+		if !found {
+			continue
+		}
+		records = append(records, user)
+		retiring, found, err := retiringKey(user, svc)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			records = append(records, retiring)
+		}
+	}
+	return records, nil
+}
+
+// The record a user's key is replacing while the rotation overlaps
+func retiringKey(user User, svc *dynamodb.DynamoDB) (User, bool, error) {
+	retiring := User{}
+	if user.Replaces == "" {
+		return retiring, false, nil
+	}
+	found, err := getState(user.Replaces, &retiring, svc)
+	if err != nil || !found || retiring.ReplacedBy != user.Pubkey {
+		return User{}, false, err
+	}
+	return retiring, true, nil
+}
+
+// Record on a key which key it replaced
+func setReplaces(pubkey string, old string, svc *dynamodb.DynamoDB) error {
+	_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(pubkey),
+			},
+		},
+		UpdateExpression:    aws.String("set Replaces = :old"),
+		ConditionExpression: aws.String("attribute_exists(Pubkey)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":old": {
+				S: aws.String(old),
+			},
+		},
+	})
+	return err
+}
+
+// Build the name and device indexes, and the links from new keys to retiring
+// ones, for users added before they existed.
+// Profiles claimed by more than one key are reported for an admin to rename
+// or remove.
+func Reindex(svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("reindex", "", ok, "") }()
+	users, err := scanUsers(svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read users")
+		return false
+	}
+
+	ok = true
+	byEmail := map[string][]string{}
+	for _, v := range users {
+		if v.ReplacedBy != "" {
+			// Rotations from before Replaces was kept
+			if err := setReplaces(v.ReplacedBy, v.Pubkey, svc); err != nil && !conditionFailed(err) {
+				log.Error().Err(err).Msgf("Unable to index the retiring key of %v", v.ProfileName)
+				ok = false
+			}
+			continue
+		}
+		claimed, err := claimName(v.ProfileName, v.Pubkey, svc)
+		if err != nil {
+			log.Error().Err(err).Msgf("Unable to index %v", v.ProfileName)
+			ok = false
+			continue
+		}
+		if !claimed {
+			owner, _, _ := lookupName(v.ProfileName, svc)
+			log.Warn().Msgf("Profile %v is used by %v and %v, rename or remove one", v.ProfileName, owner, v.Pubkey)
+			ok = false
+		}
+		email := strings.ToLower(v.Email)
+		byEmail[email] = append(byEmail[email], v.Pubkey)
+	}
+
+	for email, keys := range byEmail {
+		if err := ensureIdentity(email, svc); err != nil {
+			log.Error().Err(err).Msgf("Unable to index devices of %v", email)
+			ok = false
+			continue
+		}
+		for _, key := range keys {
+			if err := addDevice(email, key, svc); err != nil {
+				log.Error().Err(err).Msgf("Unable to index devices of %v", email)
+				ok = false
+			}
+		}
+	}
+	log.Info().Msgf("Indexed %d users and %d identities", len(users), len(byEmail))
+	return ok
+}
@@ -0,0 +1,95 @@
+package user
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+)
+
+func TestClaimName(t *testing.T) {
+	_, svc := newFakeTable(t)
+	if claimed, err := claimName("alice-laptop", "a=", svc); err != nil || !claimed {
+		t.Fatalf("first claim: %v %v", claimed, err)
+	}
+	if claimed, _ := claimName("alice-laptop", "a=", svc); !claimed {
+		t.Error("the holder could not claim its own name again")
+	}
+	if claimed, _ := claimName("alice-laptop", "b=", svc); claimed {
+		t.Error("a second key claimed a held name")
+	}
+
+	if err := moveName("alice-laptop", "b=", "c=", svc); err == nil {
+		t.Error("moved a name the key does not hold")
+	}
+	if err := moveName("alice-laptop", "a=", "c=", svc); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _, _ := lookupName("alice-laptop", svc); owner != "c=" {
+		t.Errorf("name held by %v after the move, want c=", owner)
+	}
+
+	// Releasing with a key that lost the name keeps it
+	releaseName("alice-laptop", "a=", svc)
+	if owner, found, _ := lookupName("alice-laptop", svc); !found || owner != "c=" {
+		t.Errorf("name released by a former holder")
+	}
+}
+
+func TestRecordsOf(t *testing.T) {
+	table, svc := newFakeTable(t)
+	users := []User{
+		{Pubkey: "laptop=", ProfileName: "alice-laptop", Email: "alice@example.com", Replaces: "laptop-old="},
+		{Pubkey: "laptop-old=", ProfileName: "alice-laptop", Email: "alice@example.com", ReplacedBy: "laptop="},
+		{Pubkey: "phone=", ProfileName: "alice-phone", Email: "Alice@example.com", Replaces: "retired="},
+		// Indexed identities are read through Devices only
+		{Pubkey: "stray=", ProfileName: "alice-stray", Email: "alice@example.com"},
+		{Pubkey: "bob=", ProfileName: "bob-laptop", Email: "bob@example.com"},
+		{Pubkey: "bob2=", ProfileName: "bob-phone", Email: "BOB@example.com"},
+		{Pubkey: "carol=", ProfileName: "carol-laptop", Email: "carol@example.com"},
+	}
+	for _, v := range users {
+		table.put(t, v)
+	}
+	table.put(t, Identity{Pubkey: identityKey("alice@example.com"), Email: "alice@example.com", Devices: []string{"laptop=", "phone=", "removed="}})
+	// From before Devices was kept
+	table.put(t, Identity{Pubkey: identityKey("bob@example.com"), Email: "bob@example.com"})
+
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"alice@example.com", "laptop-old= laptop= phone="},
+		{"ALICE@example.com", "laptop-old= laptop= phone="},
+		{"bob@example.com", "bob2= bob="},
+		{"carol@example.com", "carol="},
+		{"dave@example.com", ""},
+	}
+	for _, tt := range tests {
+		records, err := recordsOf(tt.email, svc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, v := range records {
+			keys = append(keys, v.Pubkey)
+		}
+		sort.Strings(keys)
+		if got := strings.Join(keys, " "); got != tt.want {
+			t.Errorf("recordsOf(%v) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+
+	if !RemoveIdentity(&util.CmdVars{Email: "alice@example.com"}, svc) {
+		t.Fatal("RemoveIdentity failed")
+	}
+	for _, key := range []string{"laptop=", "laptop-old=", "phone=", identityKey("alice@example.com")} {
+		if table.has(key) {
+			t.Errorf("%v was not removed", key)
+		}
+	}
+	if !table.has("bob=") {
+		t.Error("removed another identity's device")
+	}
+}
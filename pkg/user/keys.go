@@ -0,0 +1,266 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const defaultRotationOverlap = 7 * 24 * time.Hour
+
+// Returned when a user's key is already being replaced
+var ErrRotating = errors.New("key rotation already in progress")
+
+// Give a user a new keypair and preshared key. The IP, routes and server stay
+// the same, and the old key keeps working until the overlap ends.
+func RotateKeys(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("rotate-keys", vars.ProfileName, ok, "") }()
+	user, err := getUser(vars, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+	if _, err := rotate(user, svc); err != nil {
+		log.Error().Err(err).Msgf("Unable to rotate keys for %v", vars.ProfileName)
+		return false
+	}
+	log.Info().Msg(vars.ProfileName + " succesfully rotated")
+	return true
+}
+
+// Time both keys of a rotating user stay valid (keys.rotationOverlap)
+func rotationOverlap() time.Duration {
+	if overlap := viper.GetInt("keys.rotationOverlap"); overlap > 0 {
+		return time.Second * time.Duration(overlap)
+	}
+	return defaultRotationOverlap
+}
+
+// Store a copy of the user under a new key, mark the old record as retiring
+// and deliver the new config
+func rotate(user User, svc *dynamodb.DynamoDB) (User, error) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return user, err
+	}
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		return user, err
+	}
+	now := time.Now()
+
+	next := user
+	next.Pubkey = privateKey.PublicKey().String()
+	next.Privkey = privateKey.String()
+	next.Psk = psk.String()
+	next.KeyCreated = now.Unix()
+	next.ReplacedBy = ""
+	next.RetiresAt = 0
+	next.Replaces = user.Pubkey
+
+	// A lockout must not be lifted by rotating, so it moves first
+	if err := carryLimits(user.Pubkey, next.Pubkey, svc); err != nil {
+		return user, fmt.Errorf("copying lockout: %w", err)
+	}
+
+	av, err := dynamodbattribute.MarshalMap(next)
+	if err != nil {
+		return user, err
+	}
+	table := aws.String(viper.GetString("dynamoDBTable"))
+	// Both records are written or neither, so the old key never points at a
+	// missing one. The condition makes two rotations of the same key lose to
+	// each other.
+	_, err = svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Update: &dynamodb.Update{
+					TableName: table,
+					Key: map[string]*dynamodb.AttributeValue{
+						"Pubkey": {
+							S: aws.String(user.Pubkey),
+						},
+					},
+					UpdateExpression: aws.String("set ReplacedBy = :next, RetiresAt = :retires"),
+					// The marshaller stores an empty ReplacedBy as NULL
+					ConditionExpression: aws.String("attribute_exists(Pubkey) AND (attribute_not_exists(ReplacedBy) OR attribute_type(ReplacedBy, :null) OR ReplacedBy = :empty)"),
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":next": {
+							S: aws.String(next.Pubkey),
+						},
+						":retires": {
+							N: aws.String(strconv.FormatInt(now.Add(rotationOverlap()).Unix(), 10)),
+						},
+						":empty": {
+							S: aws.String(""),
+						},
+						":null": {
+							S: aws.String("NULL"),
+						},
+					},
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName:           table,
+					Item:                av,
+					ConditionExpression: aws.String("attribute_not_exists(Pubkey)"),
+				},
+			},
+		},
+	})
+	if transactionConflict(err, 0) {
+		return user, ErrRotating
+	}
+	if err != nil {
+		return user, fmt.Errorf("storing new key: %w", err)
+	}
+	if err := moveName(next.ProfileName, user.Pubkey, next.Pubkey, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to update the name index")
+	}
+	if err := addDevice(next.Email, next.Pubkey, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to update identity")
+	} else if err := removeDevice(user.Email, user.Pubkey, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to update identity")
+	}
+	log.Info().Msgf("Rotated %v from %v to %v", user.ProfileName, user.Pubkey, next.Pubkey)
+
+	if viper.GetBool("smtp.enabled") {
+		if err := sendEmail(next, svc); err != nil {
+			return next, fmt.Errorf("sending new config: %w", err)
+		}
+	}
+	return next, nil
+}
+
+// Leader task: drop keys whose overlap has ended
+func retireKeys(svc *dynamodb.DynamoDB) error {
+	users, err := scanUsers(svc)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, v := range users {
+		if v.ReplacedBy == "" || v.RetiresAt > now {
+			continue
+		}
+		if !deleteRecord(v, svc) {
+			return fmt.Errorf("removing retired key of %v", v.ProfileName)
+		}
+		deleteUserState(v.Pubkey, svc)
+		log.Info().Msgf("Retired old key %v of %v", v.Pubkey, v.ProfileName)
+		audit.Admin("retire-key", v.ProfileName, true, v.Pubkey)
+	}
+	return nil
+}
+
+// Leader task: rotate keys older than keys.maxAge seconds. Keys from before
+// creation times were recorded start their clock now.
+func rotateAgedKeys(svc *dynamodb.DynamoDB) error {
+	maxAge := time.Second * time.Duration(viper.GetInt("keys.maxAge"))
+	if maxAge <= 0 {
+		return nil
+	}
+	users, err := scanUsers(svc)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, v := range users {
+		if v.ReplacedBy != "" || v.Disabled() {
+			continue
+		}
+		if v.KeyCreated == 0 {
+			if err := setKeyCreated(v, now, svc); err != nil {
+				return err
+			}
+			continue
+		}
+		if now.Sub(time.Unix(v.KeyCreated, 0)) < maxAge {
+			continue
+		}
+		_, err := rotate(v, svc)
+		audit.Admin("rotate-keys", v.ProfileName, err == nil, "max key age")
+		if err != nil && !errors.Is(err, ErrRotating) {
+			log.Error().Err(err).Msgf("Unable to rotate aged key of %v", v.ProfileName)
+		}
+	}
+	return nil
+}
+
+func setKeyCreated(user User, created time.Time, svc *dynamodb.DynamoDB) error {
+	_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(user.Pubkey),
+			},
+		},
+		UpdateExpression:    aws.String("set KeyCreated = :created"),
+		ConditionExpression: aws.String("attribute_exists(Pubkey)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":created": {
+				N: aws.String(strconv.FormatInt(created.Unix(), 10)),
+			},
+		},
+	})
+	if conditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Which of the keys sharing an address should carry it on this gateway. The
+// newest key takes over once it has handshaken; until then the most recently
+// used key keeps the address so rotating never cuts a live session.
+func addressHolders(users []User, handshakes map[string]time.Time) map[uint32]string {
+	holders := map[uint32]string{}
+	for _, ip := range clientIPs(users) {
+		var current, latest string
+		var latestHandshake time.Time
+		for _, v := range users {
+			if v.Clientip != ip {
+				continue
+			}
+			if v.ReplacedBy == "" {
+				current = v.Pubkey
+			}
+			if t := handshakes[v.Pubkey]; latest == "" || t.After(latestHandshake) {
+				latest = v.Pubkey
+				latestHandshake = t
+			}
+		}
+		switch {
+		case current != "" && !handshakes[current].IsZero():
+			holders[ip] = current
+		case latestHandshake.IsZero() && current != "":
+			holders[ip] = current
+		default:
+			holders[ip] = latest
+		}
+	}
+	return holders
+}
+
+func clientIPs(users []User) []uint32 {
+	seen := map[uint32]bool{}
+	ips := []uint32{}
+	for _, v := range users {
+		if !seen[v.Clientip] {
+			seen[v.Clientip] = true
+			ips = append(ips, v.Clientip)
+		}
+	}
+	return ips
+}
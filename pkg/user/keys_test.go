@@ -0,0 +1,122 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+)
+
+func TestAddressHolders(t *testing.T) {
+	now := time.Now()
+	old := User{Pubkey: "old=", Clientip: 1, ReplacedBy: "new="}
+	current := User{Pubkey: "new=", Clientip: 1}
+	other := User{Pubkey: "other=", Clientip: 2}
+
+	tests := []struct {
+		name       string
+		users      []User
+		handshakes map[string]time.Time
+		want       map[uint32]string
+	}{
+		{"single key", []User{other}, nil, map[uint32]string{2: "other="}},
+		{"no handshakes yet", []User{old, current}, nil, map[uint32]string{1: "new="}},
+		{"old key still in use", []User{old, current}, map[string]time.Time{"old=": now}, map[uint32]string{1: "old="}},
+		{"new key connected", []User{old, current}, map[string]time.Time{"old=": now, "new=": now.Add(-time.Hour)}, map[uint32]string{1: "new="}},
+		{"retiring key alone", []User{old}, nil, map[uint32]string{1: "old="}},
+		{"independent addresses", []User{old, current, other}, map[string]time.Time{"old=": now}, map[uint32]string{1: "old=", 2: "other="}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addressHolders(tt.users, tt.handshakes)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for ip, key := range tt.want {
+				if got[ip] != key {
+					t.Errorf("address %d held by %q, want %q", ip, got[ip], key)
+				}
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	table, svc := newFakeTable(t)
+	user := User{Pubkey: "old=", ProfileName: "alice-laptop", Email: "alice@example.com", Clientip: 1}
+	table.put(t, user)
+	until := time.Now().Add(time.Hour).Unix()
+	table.put(t, lockoutRecord{Pubkey: stateKey("lockout", "old="), Owner: "old=", LockedUntil: until, Expires: until})
+
+	next, err := rotate(user, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := User{}
+	if !table.get(t, next.Pubkey, &stored) || stored.ProfileName != user.ProfileName || stored.Clientip != user.Clientip || stored.Replaces != "old=" {
+		t.Fatalf("new key stored as %+v", stored)
+	}
+	retiring := User{}
+	table.get(t, "old=", &retiring)
+	if retiring.ReplacedBy != next.Pubkey || retiring.RetiresAt == 0 {
+		t.Errorf("old key not marked as replaced: %+v", retiring)
+	}
+	lockout := lockoutRecord{}
+	if !table.get(t, stateKey("lockout", next.Pubkey), &lockout) || lockout.Owner != next.Pubkey || lockout.LockedUntil != until {
+		t.Errorf("lockout not carried to the new key: %+v", lockout)
+	}
+
+	// A second rotation of the old key writes nothing
+	before := len(scan(false, svc))
+	if _, err := rotate(user, svc); !errors.Is(err, ErrRotating) {
+		t.Fatalf("got %v, want ErrRotating", err)
+	}
+	if after := len(scan(false, svc)); after != before {
+		t.Errorf("%d user records after a failed rotation, want %d", after, before)
+	}
+}
+
+func TestRotateSwitchOver(t *testing.T) {
+	_, svc := newFakeTable(t)
+	user := User{Pubkey: "old=", ProfileName: "alice-laptop", Email: "alice@example.com", Clientip: 1}
+	if ok, err := claimName(user.ProfileName, user.Pubkey, svc); !ok || err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+	if err := addRecord(user, svc); err != nil {
+		t.Fatal(err)
+	}
+	next, err := rotate(user, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key keeps the address until the new one completes a handshake
+	now := time.Now()
+	users := scan(false, svc)
+	if got := addressHolders(users, map[string]time.Time{"old=": now})[1]; got != "old=" {
+		t.Errorf("address held by %q before the switch-over, want old=", got)
+	}
+	if got := addressHolders(users, map[string]time.Time{"old=": now, next.Pubkey: now.Add(-time.Minute)})[1]; got != next.Pubkey {
+		t.Errorf("address held by %q after the switch-over, want %q", got, next.Pubkey)
+	}
+
+	// Disabling the profile also shuts out the retiring key, and enabling lets both back in
+	vars := &util.CmdVars{ProfileName: "alice-laptop", Reason: "lost laptop"}
+	if !Disable(vars, svc) {
+		t.Fatal("disable failed")
+	}
+	for _, key := range []string{"old=", next.Pubkey} {
+		if stored := GetUser(key, svc); !stored.Disabled() {
+			t.Errorf("%v not disabled: %+v", key, stored)
+		}
+	}
+	if !Enable(vars, svc) {
+		t.Fatal("enable failed")
+	}
+	for _, key := range []string{"old=", next.Pubkey} {
+		if stored := GetUser(key, svc); stored.Disabled() {
+			t.Errorf("%v still disabled: %+v", key, stored)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package user
+
+import (
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/geo"
+	"github.com/derrickmartinez/wireguard-auth/pkg/policy"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+)
+
+// Where and when a user last passed MFA
+type lastAuthRecord struct {
+	Pubkey    string
+	Latitude  float64
+	Longitude float64
+	Country   string
+	Time      int64
+}
+
+// Fetch the user's last located authentication, nil if there is none
+func LastAuth(user User, svc *dynamodb.DynamoDB) *policy.PreviousAuth {
+	record := lastAuthRecord{}
+	found, err := getState(stateKey("lastauth", user.Pubkey), &record, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read last authentication")
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	return &policy.PreviousAuth{
+		Latitude:  record.Latitude,
+		Longitude: record.Longitude,
+		Time:      time.Unix(record.Time, 0),
+	}
+}
+
+// Record a successful authentication if its location is known
+func RecordAuth(user User, loc geo.Location, svc *dynamodb.DynamoDB) {
+	if !loc.Found {
+		return
+	}
+	record := lastAuthRecord{
+		Pubkey:    stateKey("lastauth", user.Pubkey),
+		Latitude:  loc.Latitude,
+		Longitude: loc.Longitude,
+		Country:   loc.Country,
+		Time:      time.Now().Unix(),
+	}
+	if err := putState(record, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to record authentication location")
+	}
+}
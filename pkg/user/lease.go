@@ -0,0 +1,120 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/spf13/viper"
+)
+
+// A lease is a state record naming its holder: a gateway for the leader
+// lease, or a single process for short leases. It is taken and renewed with a
+// conditional write, so at most one holder has it until it expires or is
+// released.
+type leaseRecord struct {
+	Pubkey   string
+	Holder   string
+	Acquired int64
+	Expires  int64
+}
+
+// Returned when someone else holds a lease past the wait
+var ErrLeaseHeld = errors.New("lease is held elsewhere")
+
+// This gateway's name in leases and status records: ha.gatewayId, or the
+// hostname
+func gatewayID() string {
+	if id := viper.GetString("ha.gatewayId"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// A holder unique to one call, so two processes on the same host never
+// share a lease
+func processHolder() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return gatewayID() + "/" + strconv.Itoa(os.Getpid()) + "/" + hex.EncodeToString(b)
+}
+
+// Take or renew a lease for ttl. Returns false when another holder has it.
+func acquireLease(name string, holder string, ttl time.Duration, svc *dynamodb.DynamoDB) (bool, error) {
+	now := time.Now()
+	record := leaseRecord{
+		Pubkey:   stateKey("lease", name),
+		Holder:   holder,
+		Acquired: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+	}
+	return putStateIf(record, "attribute_not_exists(Pubkey) OR Holder = :me OR Expires <= :now",
+		map[string]*dynamodb.AttributeValue{
+			":me": {
+				S: aws.String(record.Holder),
+			},
+		}, svc)
+}
+
+// Give up a lease early so another holder can take it right away
+func releaseLease(name string, holder string, svc *dynamodb.DynamoDB) error {
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(stateKey("lease", name)),
+			},
+		},
+		ConditionExpression: aws.String("Holder = :me"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me": {
+				S: aws.String(holder),
+			},
+		},
+	})
+	if conditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Run fn while holding a short lease, waiting up to wait for it
+func withLease(name string, wait time.Duration, svc *dynamodb.DynamoDB, fn func() error) error {
+	const ttl = 30 * time.Second
+	holder := processHolder()
+	deadline := time.Now().Add(wait)
+	for {
+		held, err := acquireLease(name, holder, ttl, svc)
+		if err != nil {
+			return err
+		}
+		if held {
+			break
+		}
+		if time.Now().After(deadline) {
+			return ErrLeaseHeld
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	defer releaseLease(name, holder, svc)
+	return fn()
+}
+
+// Who holds a lease, empty when nobody does
+func leaseHolder(name string, svc *dynamodb.DynamoDB) (string, error) {
+	record := leaseRecord{}
+	found, err := getState(stateKey("lease", name), &record, svc)
+	if err != nil || !found {
+		return "", err
+	}
+	return record.Holder, nil
+}
@@ -0,0 +1,77 @@
+package user
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	table, svc := newFakeTable(t)
+	key := stateKey("lease", "ippool-default")
+
+	held, err := acquireLease("ippool-default", "a", time.Minute, svc)
+	if err != nil || !held {
+		t.Fatalf("first acquire: %v %v", held, err)
+	}
+	if held, _ := acquireLease("ippool-default", "b", time.Minute, svc); held {
+		t.Error("b took a lease a holds")
+	}
+
+	// Renewing extends the expiry
+	first := leaseRecord{}
+	table.get(t, key, &first)
+	table.put(t, leaseRecord{Pubkey: key, Holder: "a", Expires: first.Expires - 30})
+	if held, _ := acquireLease("ippool-default", "a", time.Minute, svc); !held {
+		t.Fatal("a could not renew its lease")
+	}
+	renewed := leaseRecord{}
+	table.get(t, key, &renewed)
+	if renewed.Expires < first.Expires {
+		t.Errorf("renewal kept expiry %v", renewed.Expires)
+	}
+
+	// An expired lease can be taken by anyone
+	table.put(t, leaseRecord{Pubkey: key, Holder: "a", Expires: time.Now().Add(-time.Second).Unix()})
+	if held, _ := acquireLease("ippool-default", "b", time.Minute, svc); !held {
+		t.Fatal("b could not take an expired lease")
+	}
+	if holder, _ := leaseHolder("ippool-default", svc); holder != "b" {
+		t.Errorf("held by %q, want b", holder)
+	}
+
+	// Only the holder releases
+	if err := releaseLease("ippool-default", "a", svc); err != nil {
+		t.Fatal(err)
+	}
+	if !table.has(key) {
+		t.Fatal("a released a lease b holds")
+	}
+	if err := releaseLease("ippool-default", "b", svc); err != nil {
+		t.Fatal(err)
+	}
+	if table.has(key) {
+		t.Error("lease still held after release")
+	}
+}
+
+func TestWithLeaseSameHost(t *testing.T) {
+	_, svc := newFakeTable(t)
+	err := withLease("ippool-default", time.Second, svc, func() error {
+		// Another add on this host waits and gives up
+		err := withLease("ippool-default", 0, svc, func() error {
+			t.Error("two calls held the lease at once")
+			return nil
+		})
+		if !errors.Is(err, ErrLeaseHeld) {
+			t.Errorf("got %v, want ErrLeaseHeld", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := leaseHolder("ippool-default", svc); holder != "" {
+		t.Errorf("lease still held by %v", holder)
+	}
+}
@@ -0,0 +1,193 @@
+package user
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultLimitWindow     = 5 * time.Minute
+	defaultLockoutDuration = 15 * time.Minute
+)
+
+type lockoutRecord struct {
+	Pubkey      string
+	Owner       string
+	LockedUntil int64
+	Expires     int64
+}
+
+type failuresRecord struct {
+	Pubkey   string
+	Failures int
+	Expires  int64
+}
+
+// Check whether a user is locked out and until when
+func Locked(user User, svc *dynamodb.DynamoDB) (time.Time, bool) {
+	record := lockoutRecord{}
+	found, err := getState(stateKey("lockout", user.Pubkey), &record, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read lockout record")
+		return time.Time{}, false
+	}
+	if !found {
+		return time.Time{}, false
+	}
+	return time.Unix(record.LockedUntil, 0), true
+}
+
+// Count a push against the per pubkey and per endpoint limits. Returns false
+// with a reason when either limit for the current window is exceeded.
+func AllowPush(user User, ip net.IP, svc *dynamodb.DynamoDB) (string, bool) {
+	window := time.Second * time.Duration(viper.GetInt("limits.window"))
+	if window <= 0 {
+		window = defaultLimitWindow
+	}
+	now := time.Now()
+	start := now.Truncate(window)
+	expires := start.Add(window).Unix()
+	windowID := strconv.FormatInt(start.Unix(), 10)
+
+	if max := viper.GetInt("limits.perPubkey"); max > 0 {
+		n, err := incrState(stateKey("rate", "key", user.Pubkey, windowID), "Count", expires, svc)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to update rate limit")
+		} else if n > max {
+			return "more than " + strconv.Itoa(max) + " pushes for this key in " + window.String(), false
+		}
+	}
+	if max := viper.GetInt("limits.perEndpoint"); max > 0 && ip != nil {
+		n, err := incrState(stateKey("rate", "ip", ip.String(), windowID), "Count", expires, svc)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to update rate limit")
+		} else if n > max {
+			return "more than " + strconv.Itoa(max) + " pushes from " + ip.String() + " in " + window.String(), false
+		}
+	}
+	return "", true
+}
+
+// Count a rejected or unanswered push. Returns true when this failure locked
+// the user out.
+func RecordFailure(user User, svc *dynamodb.DynamoDB) bool {
+	threshold := viper.GetInt("limits.lockoutThreshold")
+	if threshold <= 0 {
+		return false
+	}
+	duration := time.Second * time.Duration(viper.GetInt("limits.lockoutDuration"))
+	if duration <= 0 {
+		duration = defaultLockoutDuration
+	}
+	key := stateKey("failures", user.Pubkey)
+
+	// TTL deletes lazily, so reset a stale counter before adding to it
+	record := failuresRecord{}
+	found, err := getState(key, &record, svc)
+	if err == nil && !found {
+		deleteState(key, svc)
+	}
+
+	// Failures are forgotten after a quiet period of one lockout duration
+	now := time.Now()
+	n, err := incrState(key, "Failures", now.Add(duration).Unix(), svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to record failed push")
+		return false
+	}
+	if n < threshold {
+		return false
+	}
+
+	until := now.Add(duration).Unix()
+	lockout := lockoutRecord{
+		Pubkey:      stateKey("lockout", user.Pubkey),
+		Owner:       user.Pubkey,
+		LockedUntil: until,
+		Expires:     until,
+	}
+	// Several gateways may cross the threshold at once, only the first one
+	// to store the lockout reports it
+	stored, err := putStateIfAbsent(lockout, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to store lockout")
+		return false
+	}
+	deleteState(key, svc)
+	if !stored {
+		return true
+	}
+	log.Warn().Str("profile", user.ProfileName).Int("failures", n).Msgf("%v locked out until %v", user.ProfileName, time.Unix(until, 0).Format(time.RFC3339))
+	audit.Emit(audit.Event{
+		Actor:   "wireguard-auth",
+		Action:  "lockout",
+		Profile: user.ProfileName,
+		Email:   user.Email,
+		Result:  audit.Success,
+		Detail:  strconv.Itoa(n) + " failed pushes",
+		Reason:  "locked until " + time.Unix(until, 0).Format(time.RFC3339),
+	})
+	return true
+}
+
+// Copy a key's failure count and lockout to the key replacing it
+func carryLimits(from string, to string, svc *dynamodb.DynamoDB) error {
+	failures := failuresRecord{}
+	found, err := getState(stateKey("failures", from), &failures, svc)
+	if err != nil {
+		return err
+	}
+	if found {
+		failures.Pubkey = stateKey("failures", to)
+		if err := putState(failures, svc); err != nil {
+			return err
+		}
+	}
+	lockout := lockoutRecord{}
+	found, err = getState(stateKey("lockout", from), &lockout, svc)
+	if err != nil || !found {
+		return err
+	}
+	lockout.Pubkey = stateKey("lockout", to)
+	lockout.Owner = to
+	return putState(lockout, svc)
+}
+
+// Reset the failure count after a successful push
+func ClearFailures(user User, svc *dynamodb.DynamoDB) {
+	if viper.GetInt("limits.lockoutThreshold") <= 0 {
+		return
+	}
+	if err := deleteState(stateKey("failures", user.Pubkey), svc); err != nil {
+		log.Error().Err(err).Msg("Unable to reset failed pushes")
+	}
+}
+
+// Lift a lockout and reset the user's counters
+func Unlock(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("unlock", vars.ProfileName, ok, "") }()
+	user, err := getUser(vars, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+	for _, kind := range []string{"lockout", "failures"} {
+		if err := deleteState(stateKey(kind, user.Pubkey), svc); err != nil {
+			log.Error().Err(err).Msg("Unable to unlock user")
+			return false
+		}
+	}
+	if _, err := deleteStatePrefix(stateKey("rate", "key", user.Pubkey), svc); err != nil {
+		log.Error().Err(err).Msg("Unable to reset rate limit")
+	}
+	log.Info().Msg(vars.ProfileName + " succesfully unlocked")
+	return true
+}
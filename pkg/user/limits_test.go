@@ -0,0 +1,107 @@
+package user
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+)
+
+func TestRecordFailure(t *testing.T) {
+	table, svc := newFakeTable(t)
+	configure(t, map[string]interface{}{"limits.lockoutThreshold": 3, "limits.lockoutDuration": 600})
+	alice := User{Pubkey: "alice=", ProfileName: "alice-laptop"}
+	table.put(t, alice)
+
+	for i := 1; i < 3; i++ {
+		if RecordFailure(alice, svc) {
+			t.Fatalf("locked out after %d failures", i)
+		}
+	}
+	// A success in between starts the count over
+	ClearFailures(alice, svc)
+	for i := 1; i < 3; i++ {
+		if RecordFailure(alice, svc) {
+			t.Fatalf("locked out after %d failures since the last success", i)
+		}
+	}
+	if !RecordFailure(alice, svc) {
+		t.Fatal("not locked out at the threshold")
+	}
+	until, locked := Locked(alice, svc)
+	if !locked || until.Before(time.Now().Add(9*time.Minute)) {
+		t.Errorf("locked %v until %v, want about 10 minutes", locked, until)
+	}
+	if _, locked := Locked(User{Pubkey: "bob="}, svc); locked {
+		t.Error("another key is locked out")
+	}
+
+	// Lockouts end when their record expires, before TTL removes it
+	table.put(t, lockoutRecord{Pubkey: stateKey("lockout", "alice="), Owner: "alice=", LockedUntil: time.Now().Add(-time.Second).Unix(), Expires: time.Now().Add(-time.Second).Unix()})
+	if _, locked := Locked(alice, svc); locked {
+		t.Error("still locked out after the lockout expired")
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	table, svc := newFakeTable(t)
+	configure(t, map[string]interface{}{"limits.lockoutThreshold": 1, "limits.perPubkey": 1})
+	alice := User{Pubkey: "alice=", ProfileName: "alice-laptop"}
+	table.put(t, alice)
+	table.put(t, nameRecord{Pubkey: nameKey("alice-laptop"), Owner: "alice="})
+
+	AllowPush(alice, nil, svc)
+	if _, ok := AllowPush(alice, nil, svc); ok {
+		t.Fatal("rate limit not reached")
+	}
+	if !RecordFailure(alice, svc) {
+		t.Fatal("not locked out")
+	}
+	if !Unlock(&util.CmdVars{ProfileName: "alice-laptop"}, svc) {
+		t.Fatal("unlock failed")
+	}
+	if _, locked := Locked(alice, svc); locked {
+		t.Error("still locked out after unlock")
+	}
+	if _, ok := AllowPush(alice, nil, svc); !ok {
+		t.Error("rate limit kept after unlock")
+	}
+}
+
+func TestAllowPush(t *testing.T) {
+	_, svc := newFakeTable(t)
+	configure(t, map[string]interface{}{"limits.perPubkey": 2, "limits.perEndpoint": 2, "limits.window": 1})
+	alice := User{Pubkey: "alice="}
+	bob := User{Pubkey: "bob="}
+	carol := User{Pubkey: "carol="}
+	home := net.ParseIP("198.51.100.7")
+	cafe := net.ParseIP("203.0.113.9")
+
+	// Start at the beginning of a window so the steps below share it
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	steps := []struct {
+		user User
+		ip   net.IP
+		want bool
+	}{
+		{alice, home, true},
+		{alice, cafe, true},
+		{alice, nil, false},
+		// Other keys have their own counts, but share the endpoint's
+		{bob, home, true},
+		{bob, home, false},
+		{carol, cafe, true},
+	}
+	for i, s := range steps {
+		if reason, ok := AllowPush(s.user, s.ip, svc); ok != s.want {
+			t.Fatalf("step %d: allowed %v (%v), want %v", i, ok, reason, s.want)
+		}
+	}
+
+	// The next window starts over
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	if reason, ok := AllowPush(alice, home, svc); !ok {
+		t.Errorf("refused in a new window: %v", reason)
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
 	"github.com/derrickmartinez/wireguard-auth/pkg/util"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,57 +31,117 @@ type User struct {
 	Psk         string
 	Clientip    uint32
 	Routesallow string
+	Rule        string
 	Email       string
+	// Name of the device this key is for; a person's devices share Email
+	Device      string
 	Splittunnel bool
 	Serial      int
-}
-
-type Rule struct {
-	Route string
-	Proto string
-	Port  int
+	// Unix time the keypair was generated, 0 for keys from before it was kept
+	KeyCreated int64
+	// Set on the old record while a key rotation overlaps
+	ReplacedBy string
+	RetiresAt  int64
+	// The key this one replaced, kept so the retiring record can be found
+	// without a scan
+	Replaces string
+	// Server instance the user connects to, empty for the first server
+	Server string
+	// Unix time access ends, 0 for never. Not Expires, which is the TTL
+	// attribute and would have DynamoDB delete the record.
+	ExpiresAt int64
+	// Temporary extra routes
+	Grants []Grant
+	// Empty while the user may connect, see status.go
+	Status        string
+	StatusReason  string
+	StatusChanged int64
+	// Resolved identity provider IDs, cached to skip lookups on every auth
+	OktaUserId   string
+	OktaFactorId string
 }
 
 // Add a user to the DynamoDB table
-func Add(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
-	var clientIP uint32 = 0
-	users := scan(false, svc)
-	if len(users) > 0 {
-		clientIP = max(users) + 1
-	} else {
-		clientIP = util.Ip2int(net.ParseIP(viper.GetString("ipPoolStart")))
+func Add(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("add", vars.ProfileName, ok, "") }()
+	cfg, err := server.Get(vars.Server)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find server")
+		return false
+	}
+	expiresAt, err := parseExpiry(vars)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid expiry")
+		return false
 	}
 
 	privateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		log.Fatal().Msgf("Error generating private key: %v", err)
+		log.Error().Err(err).Msg("Error generating private key")
+		return false
 	}
 
 	psk, err := wgtypes.GenerateKey()
 	if err != nil {
-		log.Fatal().Msgf("Error generating psk key: %v", err)
+		log.Error().Err(err).Msg("Error generating psk key")
+		return false
 	}
 
 	user := User{
 		Pubkey:      privateKey.PublicKey().String(),
-		Clientip:    clientIP,
 		ProfileName: vars.ProfileName,
 		Privkey:     privateKey.String(),
 		Psk:         psk.String(),
-		Routesallow: buildRoutes(vars),
+		Routesallow: buildRoutes(vars, cfg),
+		Rule:        buildRule(vars),
 		Email:       vars.Email,
+		Device:      vars.Device,
 		Splittunnel: vars.SplitTunnel,
 		Serial:      0,
+		KeyCreated:  time.Now().Unix(),
+		Server:      cfg.Name,
+		ExpiresAt:   expiresAt,
 	}
 
-	if !addRecord(user, svc) {
+	if err := ensureIdentity(vars.Email, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to record identity")
+		return false
+	}
+
+	// Allocate and insert under the pool's lease so concurrent adds never
+	// hand out the same address
+	err = withLease(poolLease(cfg), poolLeaseWait, svc, func() error {
+		users, err := scanUsers(svc)
+		if err != nil {
+			return err
+		}
+		claimed, err := claimName(user.ProfileName, user.Pubkey, svc)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return errors.New("profile " + user.ProfileName + " already exists")
+		}
+		user.Clientip = nextClientIP(onServer(users, cfg), cfg)
+		if _, last := cfg.Pool(); user.Clientip > last {
+			releaseName(user.ProfileName, user.Pubkey, svc)
+			return errors.New("the pool of server " + cfg.Name + " is full")
+		}
+		if err := addDeviceRecord(user, svc); err != nil {
+			releaseName(user.ProfileName, user.Pubkey, svc)
+			return fmt.Errorf("adding record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to add user")
 		return false
 	}
 
 	if viper.GetBool("smtp.enabled") {
-		err = sendEmail(user)
+		err = sendEmail(user, svc)
 		if err != nil {
-			log.Fatal().Msgf("Error sending email: %v", err)
+			log.Error().Err(err).Msg("Error sending email")
 			return false
 		}
 	}
@@ -89,16 +152,33 @@ func Add(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
 }
 
 // Find a user and remove
-func Remove(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+func Remove(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("remove", vars.ProfileName, ok, "") }()
 	curRecord, err := getUser(vars, svc)
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("Unable to find user")
 		return false
 	}
 
 	if !deleteRecord(curRecord, svc) {
 		return false
 	}
+	deleteUserState(curRecord.Pubkey, svc)
+	if err := releaseName(curRecord.ProfileName, curRecord.Pubkey, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to release profile name")
+	}
+	if err := removeDevice(curRecord.Email, curRecord.Pubkey, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to update identity")
+	}
+
+	// Keys still retiring after a rotation go too
+	for _, v := range scan(false, svc) {
+		if v.ReplacedBy != "" && v.ProfileName == curRecord.ProfileName && v.Clientip == curRecord.Clientip {
+			if deleteRecord(v, svc) {
+				deleteUserState(v.Pubkey, svc)
+			}
+		}
+	}
 
 	log.Info().Msg(vars.ProfileName + " succesfully removed")
 
@@ -114,45 +194,76 @@ func List(svc *dynamodb.DynamoDB) {
 
 	w := new(tabwriter.Writer)
 	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
-	fmt.Fprintln(w, "Profile\tEmail\tPublic Key\tClient IP\tSplit tunnel?")
+	fmt.Fprintln(w, "Profile\tEmail\tDevice\tServer\tPublic Key\tClient IP\tSplit tunnel?\tStatus\tExpires")
 
 	for _, v := range users {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", v.ProfileName, v.Email, v.Pubkey, util.Int2ip(v.Clientip), v.Splittunnel)
+		pubkey := v.Pubkey
+		if v.ReplacedBy != "" {
+			pubkey += " (retiring " + time.Unix(v.RetiresAt, 0).Format("2006-01-02") + ")"
+		}
+		expires := "never"
+		if v.ExpiresAt > 0 {
+			expires = time.Unix(v.ExpiresAt, 0).Format(time.RFC3339)
+		}
+		if n := len(activeGrants(v, time.Now())); n > 0 {
+			expires += fmt.Sprintf(" (%d grants)", n)
+		}
+		status := "active"
+		switch {
+		case v.Disabled():
+			status = StatusDisabled
+			if v.StatusReason != "" {
+				status += " (" + v.StatusReason + ")"
+			}
+		case v.Expired(time.Now()):
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", v.ProfileName, v.Email, v.Device, serverName(v), pubkey, util.Int2ip(v.Clientip), v.Splittunnel, status, expires)
 	}
 	w.Flush()
 }
 
 // Resend a user's email
-func ResendEmail(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+func ResendEmail(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("resend-email", vars.ProfileName, ok, "") }()
 	user, err := getUser(vars, svc)
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("Unable to find user")
 		return false
 	}
-	err = sendEmail(user)
+	err = sendEmail(user, svc)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error sending email")
+		log.Error().Err(err).Msg("Error sending email")
 		return false
 	}
 	return true
 }
 
 // Update a user's allowed routes
-func UpdateRoutes(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+func UpdateRoutes(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("update-routes", vars.ProfileName, ok, "") }()
 	user, err := getUser(vars, svc)
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+	cfg, err := server.Get(user.Server)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find the user's server")
 		return false
 	}
 
 	input := &dynamodb.UpdateItemInput{
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":routes": {
-				S: aws.String(strings.Replace(buildRoutes(vars), " ", "", -1)),
+				S: aws.String(strings.Replace(buildRoutes(vars, cfg), " ", "", -1)),
 			},
 			":serial": {
 				N: aws.String(strconv.Itoa(user.Serial + 1)),
 			},
+			":rule": {
+				S: aws.String(buildRule(vars)),
+			},
 		},
 		TableName: aws.String(viper.GetString("dynamoDBTable")),
 		Key: map[string]*dynamodb.AttributeValue{
@@ -160,12 +271,16 @@ func UpdateRoutes(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
 				S: aws.String(user.Pubkey),
 			},
 		},
-		UpdateExpression: aws.String("set Routesallow = :routes, Serial = :serial"),
+		UpdateExpression: aws.String("set Routesallow = :routes, Serial = :serial, #rule = :rule"),
+		// RULE is a reserved word in DynamoDB expressions
+		ExpressionAttributeNames: map[string]*string{
+			"#rule": aws.String("Rule"),
+		},
 	}
 
 	_, err = svc.UpdateItem(input)
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("Unable to update routes")
 		return false
 	}
 
@@ -200,8 +315,19 @@ func GetUser(pubKey string, svc *dynamodb.DynamoDB) User {
 	return user
 }
 
-// Get user by profile name
+// Get user by profile name through the name index, scanning for users added
+// before the index existed
 func getUser(vars *util.CmdVars, svc *dynamodb.DynamoDB) (User, error) {
+	pubkey, found, err := lookupName(vars.ProfileName, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read the name index")
+	}
+	if found {
+		if user := GetUser(pubkey, svc); user.Pubkey != "" {
+			return user, nil
+		}
+	}
+
 	users := scan(false, svc)
 	if len(users) == 0 {
 		return User{}, errors.New("There are no users in the table")
@@ -214,6 +340,44 @@ func getUser(vars *util.CmdVars, svc *dynamodb.DynamoDB) (User, error) {
 	return user, nil
 }
 
+// Users assigned to a server. Users added before servers could be named
+// belong to the first server.
+func onServer(users []User, cfg server.Config) []User {
+	first, _ := server.Get("")
+	assigned := []User{}
+	for _, v := range users {
+		if v.Server == cfg.Name || (v.Server == "" && cfg.Name == first.Name) {
+			assigned = append(assigned, v)
+		}
+	}
+	return assigned
+}
+
+// The name of a user's server for display
+func serverName(user User) string {
+	if user.Server == "" {
+		if first, err := server.Get(""); err == nil {
+			return first.Name
+		}
+	}
+	return user.Server
+}
+
+// How long Add waits for another add to the same pool to finish
+const poolLeaseWait = 15 * time.Second
+
+func poolLease(cfg server.Config) string {
+	return "ippool-" + cfg.Name
+}
+
+// The next free address in a server's pool; each server allocates from its own
+func nextClientIP(users []User, cfg server.Config) uint32 {
+	if len(users) > 0 {
+		return max(users) + 1
+	}
+	return util.Ip2int(net.ParseIP(cfg.IPPoolStart))
+}
+
 // Find max
 func max(arr []User) uint32 {
 	var max uint32 = arr[0].Clientip
@@ -227,33 +391,51 @@ func max(arr []User) uint32 {
 
 // Scan DynamoDB and return a slice of structs
 func scan(filter bool, svc *dynamodb.DynamoDB) []User {
+	users, err := scanUsers(svc)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to scan users")
+	}
+	return users
+}
+
+// Scan every user, reporting errors instead of returning a partial list
+func scanUsers(svc *dynamodb.DynamoDB) ([]User, error) {
 	table := aws.String(viper.GetString("dynamoDBTable"))
 
+	// Skip state records, see state.go
 	params := &dynamodb.ScanInput{
-		TableName: table,
+		TableName:        table,
+		FilterExpression: aws.String("NOT contains(Pubkey, :sep)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sep": {
+				S: aws.String(stateSep),
+			},
+		},
 	}
 
 	users := []User{}
-
-	result, err := svc.Scan(params)
+	items := []map[string]*dynamodb.AttributeValue{}
+	err := svc.ScanPages(params, func(page *dynamodb.ScanOutput, last bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
 	if err != nil {
-		log.Error().Err(err).Msg("failed to make Query API call")
+		return users, err
 	}
 
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &users)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &users)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to unmarshal Query result items")
+		return []User{}, err
 	}
 
-	return users
+	return users, nil
 }
 
 // Add record
-func addRecord(user User, svc *dynamodb.DynamoDB) bool {
+func addRecord(user User, svc *dynamodb.DynamoDB) error {
 	av, err := dynamodbattribute.MarshalMap(user)
 	if err != nil {
-		log.Fatal().Err(err)
-		return false
+		return err
 	}
 
 	input := &dynamodb.PutItemInput{
@@ -262,30 +444,34 @@ func addRecord(user User, svc *dynamodb.DynamoDB) bool {
 	}
 
 	_, err = svc.PutItem(input)
+	return err
+}
+
+// Send config to user via email
+func sendEmail(user User, svc *dynamodb.DynamoDB) error {
+	cfg, err := server.Get(user.Server)
 	if err != nil {
-		log.Fatal().Err(err)
-		return false
+		return err
 	}
-
-	return true
+	return sendConfig(user, EffectiveServer(cfg, svc), "")
 }
 
-// Send config to user via email
-func sendEmail(user User) error {
+// Send a user's config for a server, with note ahead of the usual body
+func sendConfig(user User, cfg server.Config, note string) error {
 	routes := ""
 	if user.Splittunnel {
-		routes = strings.Join(viper.GetStringSlice("clientConfig.routes"), ", ")
+		routes = strings.Join(cfg.ClientConfig.Routes, ", ")
 	} else {
 		routes = "0.0.0.0/0"
 	}
-	serverPubkey, err := wgtypes.ParseKey(viper.GetString("server.privateKey"))
+	serverPubkey, err := wgtypes.ParseKey(cfg.PrivateKey)
 	if err != nil {
 		log.Error().Err(err)
 	}
 
 	dns := ""
-	if viper.GetString("clientConfig.dns") != "" {
-		dns = "DNS = " + viper.GetString("clientConfig.dns") + "\n"
+	if cfg.ClientConfig.DNS != "" {
+		dns = "DNS = " + cfg.ClientConfig.DNS + "\n"
 	}
 
 	config := "[Interface]\nPrivateKey = " + user.Privkey + "\n" +
@@ -293,38 +479,55 @@ func sendEmail(user User) error {
 		"\n[Peer]\nPublicKey = " + serverPubkey.PublicKey().String() + "\n" +
 		"PresharedKey = " + user.Psk + "\n" +
 		"AllowedIPs = " + routes + "\n" +
-		"Endpoint = " + viper.GetString("clientConfig.serverAddress") + "\n" +
+		"Endpoint = " + cfg.ClientConfig.ServerAddress + "\n" +
 		"PersistentKeepalive = 25\n"
 	e := email.NewEmail()
 	e.From = viper.GetString("smtp.from")
 	e.To = []string{user.Email}
 	e.Subject = "Wireguard VPN config [" + user.ProfileName + "]"
-	e.Text = []byte(viper.GetString("smtp.body"))
+	e.Text = []byte(note + viper.GetString("smtp.body"))
 	e.Attach(strings.NewReader(config), user.ProfileName+".conf", "application/octet-stream")
 
-	if viper.GetBool("smtp.authLogin") {
-		err := e.Send(viper.GetString("smtp.server")+":"+viper.GetString("smtp.port"), smtp.PlainAuth("", viper.GetString("smtp.username"), viper.GetString("smtp.password"), viper.GetString("smtp.server")))
-		if err != nil {
-			return err
-		}
-	} else {
-		err := e.Send(viper.GetString("smtp.server")+":"+viper.GetString("smtp.port"), nil)
-		if err != nil {
-			return err
-		}
+	if err := deliver(e); err != nil {
+		return err
 	}
 	log.Info().Msgf("Email sent to %v", user.Email)
 	return nil
 }
 
-// Find a public key from the profile name
+// Send a plain text notice to a user via email
+func SendNotice(user User, subject string, body string) error {
+	e := email.NewEmail()
+	e.From = viper.GetString("smtp.from")
+	e.To = []string{user.Email}
+	e.Subject = subject + " [" + user.ProfileName + "]"
+	e.Text = []byte(body)
+	return deliver(e)
+}
+
+// Send an email through the configured SMTP server
+func deliver(e *email.Email) error {
+	addr := viper.GetString("smtp.server") + ":" + viper.GetString("smtp.port")
+	if viper.GetBool("smtp.authLogin") {
+		return e.Send(addr, smtp.PlainAuth("", viper.GetString("smtp.username"), viper.GetString("smtp.password"), viper.GetString("smtp.server")))
+	}
+	return e.Send(addr, nil)
+}
+
+// Find a public key from the profile name, preferring the current key over
+// one retiring after a rotation
 func findUser(users []User, profilename string) User {
+	found := User{}
 	for _, v := range users {
-		if v.ProfileName == profilename {
+		if v.ProfileName != profilename {
+			continue
+		}
+		if v.ReplacedBy == "" {
 			return v
 		}
+		found = v
 	}
-	return User{}
+	return found
 }
 
 // Delete record
@@ -348,31 +551,51 @@ func deleteRecord(user User, svc *dynamodb.DynamoDB) bool {
 	return true
 }
 
-func buildRoutes(vars *util.CmdVars) string {
-	routes := ""
+func buildRoutes(vars *util.CmdVars, cfg server.Config) string {
 	if len(vars.Routes) > 0 {
-		routes = strings.Replace(vars.Routes, " ", "", -1)
-	} else {
-		var rules []Rule
-		err := viper.UnmarshalKey("ruleProfiles."+vars.Rule, &rules)
-		if err != nil {
-			log.Error().Err(err)
-			return ""
-		}
-		if len(rules) == 0 {
-			log.Error().Msg("Unable to match the specifed rule against ruleProfiles")
-			return ""
+		return strings.Replace(vars.Routes, " ", "", -1)
+	}
+	routes := ruleRoutes(vars.Rule, cfg)
+	if routes == "" {
+		log.Error().Msg("Unable to match the specifed rule against ruleProfiles")
+	}
+	return routes
+}
+
+// The rule a user's routes come from, empty when explicit routes were given
+func buildRule(vars *util.CmdVars) string {
+	if len(vars.Routes) > 0 {
+		return ""
+	}
+	return vars.Rule
+}
+
+// Expand a server's rule profile from the current config into a routes string
+func ruleRoutes(rule string, cfg server.Config) string {
+	rules, err := cfg.Rules(rule)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read ruleProfiles")
+		return ""
+	}
+
+	var tmpRoutes []string
+	for _, r := range rules {
+		if r.Port != 0 {
+			tmpRoutes = append(tmpRoutes, r.Route+"->"+strconv.Itoa(r.Port)+"/"+r.Proto)
+		} else {
+			tmpRoutes = append(tmpRoutes, r.Route)
 		}
+	}
+	return strings.Join(tmpRoutes, ",")
+}
 
-		var tmpRoutes []string
-		for _, r := range rules {
-			if r.Port != 0 {
-				tmpRoutes = append(tmpRoutes, r.Route+"->"+strconv.Itoa(r.Port)+"/"+r.Proto)
-			} else {
-				tmpRoutes = append(tmpRoutes, r.Route)
-			}
+// The routes to enforce for a user. Users added with a rule follow the rule
+// profile as currently configured, so edits apply on the next reload.
+func userRoutes(user User, cfg server.Config) string {
+	if user.Rule != "" {
+		if routes := ruleRoutes(user.Rule, cfg); routes != "" {
+			return routes
 		}
-		routes = strings.Join(tmpRoutes, ",")
 	}
-	return routes
+	return user.Routesallow
 }
@@ -0,0 +1,44 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
+
+	"github.com/spf13/viper"
+)
+
+func TestOnServer(t *testing.T) {
+	viper.Set("servers", []map[string]interface{}{
+		{"name": "engineering", "wgInterface": "wg0", "ipPoolStart": "172.20.0.2"},
+		{"name": "contractors", "wgInterface": "wg1", "ipPoolStart": "172.21.0.2"},
+	})
+	t.Cleanup(func() { viper.Set("servers", nil) })
+	users := []User{
+		{Pubkey: "legacy="},
+		{Pubkey: "eng=", Server: "engineering"},
+		{Pubkey: "vendor=", Server: "contractors"},
+		{Pubkey: "gone=", Server: "retired"},
+	}
+
+	tests := []struct {
+		server string
+		want   []string
+	}{
+		{"engineering", []string{"legacy=", "eng="}},
+		{"contractors", []string{"vendor="}},
+		{"unknown", nil},
+	}
+	for _, tt := range tests {
+		got := onServer(users, server.Config{Name: tt.server})
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: got %+v, want %v", tt.server, got, tt.want)
+			continue
+		}
+		for i, key := range tt.want {
+			if got[i].Pubkey != key {
+				t.Errorf("%v: user %d is %v, want %v", tt.server, i, got[i].Pubkey, key)
+			}
+		}
+	}
+}
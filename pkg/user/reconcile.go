@@ -0,0 +1,240 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/idp"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// What reconciliation does about a user, set per cause in idp.reconcile
+const (
+	reconcileDisable = "disable"
+	reconcileRemove  = "remove"
+	reconcileReport  = "report"
+	reconcileEnable  = "enable"
+)
+
+const (
+	defaultReconcileInterval = time.Hour
+	// Marks users disabled by reconciliation, so only those are enabled again
+	idpReasonPrefix = "idp: "
+)
+
+// A change to the devices of one identity
+type reconcileChange struct {
+	Email   string
+	Cause   string
+	Action  string
+	Devices []User
+}
+
+// Compare users against the identity provider and disable or remove those
+// that are gone from it. With --dry-run only the report is printed.
+func ReconcileIdp(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	if !vars.DryRun {
+		defer func() { audit.Admin("reconcile-idp", "", ok, "") }()
+	}
+	changes, err := planReconcile(svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reconcile with the identity provider")
+		return false
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Email\tProfiles\tIdP\tAction")
+	for _, c := range changes {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", c.Email, strings.Join(profiles(c.Devices), ", "), c.Cause, c.Action)
+	}
+	w.Flush()
+	if len(changes) == 0 {
+		fmt.Println("Every user matches the identity provider")
+	}
+	if vars.DryRun {
+		return true
+	}
+	if err := applyReconcile(changes, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to apply some changes")
+		return false
+	}
+	return true
+}
+
+// Leader task: reconcile once every idp.reconcile.interval seconds when
+// idp.reconcile.enabled is set
+func reconcileIdp(svc *dynamodb.DynamoDB) error {
+	if !viper.GetBool("idp.reconcile.enabled") {
+		return nil
+	}
+	interval := defaultReconcileInterval
+	if seconds := viper.GetInt("idp.reconcile.interval"); seconds > 0 {
+		interval = time.Second * time.Duration(seconds)
+	}
+	if !once(stateKey("reconcile", "idp"), time.Now().Add(interval).Unix(), svc) {
+		return nil
+	}
+	changes, err := planReconcile(svc)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		log.Info().Msgf("Identity provider reports %v %v, will %v %v", c.Email, c.Cause, c.Action, strings.Join(profiles(c.Devices), ", "))
+	}
+	return applyReconcile(changes, svc)
+}
+
+// Look up every identity in the provider and work out what to change.
+// Identities that can't be looked up are logged and left alone.
+func planReconcile(svc *dynamodb.DynamoDB) ([]reconcileChange, error) {
+	provider, err := idp.New()
+	if err != nil {
+		return nil, err
+	}
+	users, err := scanUsers(svc)
+	if err != nil {
+		return nil, err
+	}
+	excluded := map[string]bool{}
+	for _, v := range viper.GetStringSlice("idp.reconcile.exclude") {
+		excluded[strings.ToLower(v)] = true
+	}
+	byEmail := map[string][]User{}
+	for _, v := range users {
+		email := strings.ToLower(v.Email)
+		if v.ReplacedBy == "" && !excluded[email] {
+			byEmail[email] = append(byEmail[email], v)
+		}
+	}
+	emails := []string{}
+	for k := range byEmail {
+		emails = append(emails, k)
+	}
+	sort.Strings(emails)
+
+	allowed := viper.GetStringSlice("idp.allowedGroups")
+	changes := []reconcileChange{}
+	for _, email := range emails {
+		devices := byEmail[email]
+		id := ""
+		for _, v := range devices {
+			if v.OktaUserId != "" {
+				id = v.OktaUserId
+			}
+		}
+		account, err := provider.Lookup(email, id)
+		if err != nil {
+			log.Error().Err(err).Msgf("Unable to look up %v in the identity provider", email)
+			continue
+		}
+
+		change := reconcileChange{Email: email, Cause: account.Status}
+		switch {
+		case account.Status == idp.Suspended:
+			change.Action = reconcileAction("idp.reconcile.onSuspended")
+		case account.Status == idp.Deprovisioned:
+			change.Action = reconcileAction("idp.reconcile.onDeprovisioned")
+		case len(allowed) > 0 && !account.InAny(allowed):
+			change.Cause = "not in idp.allowedGroups"
+			change.Action = reconcileAction("idp.reconcile.onLeftGroup")
+		default:
+			change.Action = reconcileEnable
+		}
+
+		// Only list devices the action would change
+		for _, v := range devices {
+			switch change.Action {
+			case reconcileDisable:
+				if v.Disabled() {
+					continue
+				}
+			case reconcileEnable:
+				if !v.Disabled() || !strings.HasPrefix(v.StatusReason, idpReasonPrefix) {
+					continue
+				}
+			}
+			change.Devices = append(change.Devices, v)
+		}
+		if len(change.Devices) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// The action configured for a cause, disable when unset
+func reconcileAction(key string) string {
+	switch action := strings.ToLower(viper.GetString(key)); action {
+	case reconcileRemove, reconcileReport:
+		return action
+	case "", reconcileDisable:
+		return reconcileDisable
+	default:
+		log.Warn().Msgf("Unknown action %q for %v, disabling instead", action, key)
+		return reconcileDisable
+	}
+}
+
+// Carry out planned changes. Refuses when more identities would be disabled
+// or removed than idp.reconcile.maxChanges, which guards against an outage
+// or misconfiguration of the provider cutting everyone off.
+func applyReconcile(changes []reconcileChange, svc *dynamodb.DynamoDB) error {
+	revoking := 0
+	for _, c := range changes {
+		if c.Action == reconcileDisable || c.Action == reconcileRemove {
+			revoking++
+		}
+	}
+	if max := viper.GetInt("idp.reconcile.maxChanges"); max > 0 && revoking > max {
+		return fmt.Errorf("%d users would be disabled or removed, more than idp.reconcile.maxChanges (%d); check the report with --dry-run", revoking, max)
+	}
+
+	var errs []error
+	for _, c := range changes {
+		reason := idpReasonPrefix + c.Cause
+		switch c.Action {
+		case reconcileDisable:
+			for _, v := range c.Devices {
+				err := setStatus(v, StatusDisabled, reason, svc)
+				audit.Admin("disable", v.ProfileName, err == nil, reason)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("disabling %v: %w", v.ProfileName, err))
+				}
+			}
+		case reconcileEnable:
+			for _, v := range c.Devices {
+				err := setStatus(v, "", "", svc)
+				audit.Admin("enable", v.ProfileName, err == nil, "idp: active")
+				if err != nil {
+					errs = append(errs, fmt.Errorf("enabling %v: %w", v.ProfileName, err))
+				}
+			}
+		case reconcileRemove:
+			if !RemoveIdentity(&util.CmdVars{Email: c.Email}, svc) {
+				errs = append(errs, fmt.Errorf("removing %v", c.Email))
+			}
+		case reconcileReport:
+			log.Warn().Msgf("Identity provider reports %v %v, leaving %v as is", c.Email, c.Cause, strings.Join(profiles(c.Devices), ", "))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func profiles(users []User) []string {
+	names := []string{}
+	for _, v := range users {
+		names = append(names, v.ProfileName)
+	}
+	return names
+}
@@ -0,0 +1,196 @@
+package user
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/idp"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/spf13/viper"
+)
+
+// Users as a SCIM provider would export them. carol and svc are missing.
+const scimFixture = `{
+  "schemas": ["urn:ietf:params:scim:api:messages:2.0:ListResponse"],
+  "Resources": [
+    {"id": "1", "userName": "alice@example.com", "active": true, "groups": [{"display": "VPN"}]},
+    {"id": "2", "userName": "bob", "active": false, "emails": [{"value": "bob@example.com"}], "groups": [{"display": "VPN"}]},
+    {"id": "4", "userName": "dave@example.com", "active": true, "groups": [{"display": "Sales"}]},
+    {"id": "5", "userName": "erin@example.com", "active": true, "groups": [{"display": "vpn"}]},
+    {"id": "6", "userName": "frank@example.com", "active": true, "groups": [{"display": "VPN"}]}
+  ]
+}`
+
+func reconcileFixture(t *testing.T, config map[string]interface{}) (*fakeTable, *dynamodb.DynamoDB) {
+	t.Helper()
+	table, svc := newFakeTable(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(scimFixture), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]interface{}{
+		"idp.provider":      "scim",
+		"idp.scim.file":     path,
+		"idp.allowedGroups": []string{"VPN"},
+	}
+	for k, v := range config {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range settings {
+			viper.Set(k, nil)
+		}
+	})
+
+	users := []User{
+		{Pubkey: "alice=", ProfileName: "alice-laptop", Email: "alice@example.com", Clientip: 1},
+		{Pubkey: "bob=", ProfileName: "bob-laptop", Email: "bob@example.com", Clientip: 2, Replaces: "bob-old="},
+		{Pubkey: "bob-old=", ProfileName: "bob-laptop", Email: "bob@example.com", Clientip: 2, ReplacedBy: "bob="},
+		{Pubkey: "carol=", ProfileName: "carol-laptop", Email: "carol@example.com", Clientip: 3},
+		{Pubkey: "carol2=", ProfileName: "carol-phone", Email: "Carol@example.com", Clientip: 4},
+		{Pubkey: "dave=", ProfileName: "dave-laptop", Email: "dave@example.com", Clientip: 5},
+		{Pubkey: "erin=", ProfileName: "erin-laptop", Email: "erin@example.com", Clientip: 6, Status: StatusDisabled, StatusReason: idpReasonPrefix + idp.Suspended},
+		{Pubkey: "frank=", ProfileName: "frank-laptop", Email: "frank@example.com", Clientip: 7, Status: StatusDisabled, StatusReason: "left the team"},
+		{Pubkey: "svc=", ProfileName: "build-runner", Email: "svc@example.com", Clientip: 8},
+	}
+	for _, v := range users {
+		table.put(t, v)
+	}
+	table.put(t, Identity{Pubkey: identityKey("carol@example.com"), Email: "carol@example.com"})
+	return table, svc
+}
+
+func TestPlanReconcile(t *testing.T) {
+	_, svc := reconcileFixture(t, map[string]interface{}{"idp.reconcile.exclude": []string{"SVC@example.com"}})
+	changes, err := planReconcile(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]struct {
+		cause   string
+		action  string
+		devices int
+	}{
+		"bob@example.com":   {idp.Suspended, reconcileDisable, 1},
+		"carol@example.com": {idp.Deprovisioned, reconcileDisable, 2},
+		"dave@example.com":  {"not in idp.allowedGroups", reconcileDisable, 1},
+		"erin@example.com":  {idp.Active, reconcileEnable, 1},
+	}
+	if len(changes) != len(want) {
+		t.Errorf("got %d changes, want %d: %+v", len(changes), len(want), changes)
+	}
+	for _, c := range changes {
+		w, found := want[c.Email]
+		if !found {
+			t.Errorf("unexpected change for %v: %v", c.Email, c.Action)
+			continue
+		}
+		if c.Cause != w.cause || c.Action != w.action || len(c.Devices) != w.devices {
+			t.Errorf("%v: got %v/%v with %d devices, want %v/%v with %d", c.Email, c.Cause, c.Action, len(c.Devices), w.cause, w.action, w.devices)
+		}
+	}
+}
+
+func TestApplyReconcile(t *testing.T) {
+	table, svc := reconcileFixture(t, nil)
+	changes, err := planReconcile(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyReconcile(changes, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	status := map[string]string{
+		"alice=":   "",
+		"bob=":     StatusDisabled,
+		"bob-old=": StatusDisabled,
+		"carol=":   StatusDisabled,
+		"carol2=":  StatusDisabled,
+		"dave=":    StatusDisabled,
+		"erin=":    "",
+		"frank=":   StatusDisabled,
+		// Not excluded this time, and missing from the provider
+		"svc=": StatusDisabled,
+	}
+	for key, want := range status {
+		user := User{}
+		if !table.get(t, key, &user) {
+			t.Errorf("%v was removed", key)
+			continue
+		}
+		if user.Status != want {
+			t.Errorf("%v: status %q, want %q", key, user.Status, want)
+		}
+	}
+	frank := User{}
+	table.get(t, "frank=", &frank)
+	if frank.StatusReason != "left the team" {
+		t.Errorf("manual disable reason replaced with %q", frank.StatusReason)
+	}
+	bob := User{}
+	table.get(t, "bob=", &bob)
+	if bob.StatusReason != idpReasonPrefix+idp.Suspended {
+		t.Errorf("bob disabled with reason %q", bob.StatusReason)
+	}
+}
+
+func TestApplyReconcileRemove(t *testing.T) {
+	table, svc := reconcileFixture(t, map[string]interface{}{
+		"idp.reconcile.onDeprovisioned": "remove",
+		"idp.reconcile.onSuspended":     "report",
+		"idp.reconcile.exclude":         []string{"svc@example.com"},
+	})
+	changes, err := planReconcile(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyReconcile(changes, svc); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"carol=", "carol2=", identityKey("carol@example.com")} {
+		if table.has(key) {
+			t.Errorf("%v was not removed", key)
+		}
+	}
+	bob := User{}
+	if !table.get(t, "bob=", &bob) || bob.Disabled() {
+		t.Errorf("reported user was changed: %+v", bob)
+	}
+	if !table.has("svc=") {
+		t.Error("excluded user was removed")
+	}
+}
+
+func TestApplyReconcileMaxChanges(t *testing.T) {
+	table, svc := reconcileFixture(t, map[string]interface{}{"idp.reconcile.maxChanges": 2})
+	changes, err := planReconcile(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := table.writeCount()
+	if err := applyReconcile(changes, svc); err == nil {
+		t.Fatal("applied more changes than idp.reconcile.maxChanges")
+	}
+	if table.writeCount() != before {
+		t.Errorf("%d writes after refusing", table.writeCount()-before)
+	}
+}
+
+func TestReconcileIdpDryRun(t *testing.T) {
+	table, svc := reconcileFixture(t, nil)
+	before := table.writeCount()
+	if !ReconcileIdp(&util.CmdVars{DryRun: true}, svc) {
+		t.Fatal("dry run failed")
+	}
+	if table.writeCount() != before {
+		t.Errorf("dry run made %d writes", table.writeCount()-before)
+	}
+}
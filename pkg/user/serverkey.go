@@ -0,0 +1,354 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	defaultSwitchDelay      = 7 * 24 * time.Hour
+	defaultDeliveryAttempts = 5
+)
+
+// A staged server key. Client configs carrying the new public key go out
+// ahead of SwitchAt, when every gateway moves the interface to the
+// nextPrivateKey in its config. The private key is never stored here, since
+// every auth process can read the table.
+type serverKeyRecord struct {
+	Pubkey    string
+	Server    string
+	PublicKey string
+	Staged    int64
+	SwitchAt  int64
+}
+
+// Whether a user has been sent a config for the staged key
+type keyDeliveryRecord struct {
+	Pubkey    string
+	Owner     string
+	Profile   string
+	Delivered int64
+	Attempts  int
+	Error     string
+}
+
+func serverKeyKey(name string) string {
+	return stateKey("serverkey", name)
+}
+
+func keyDeliveryKey(name string, pubkey string) string {
+	return stateKey("serverkey", name, pubkey)
+}
+
+// Stage the server's nextPrivateKey. The sync leader emails every user of the
+// server a config with the new public key, and the interfaces switch at
+// vars.SwitchAt.
+func RotateServerKey(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("rotate-server-key", "", ok, vars.Server) }()
+	cfg, err := server.Get(vars.Server)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find server")
+		return false
+	}
+	if cfg.NextPrivateKey == "" {
+		log.Error().Msgf("Set nextPrivateKey for %v on every gateway first, for example from `wg genkey`", cfg.Name)
+		return false
+	}
+	next, err := publicKey(cfg.NextPrivateKey)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid nextPrivateKey")
+		return false
+	}
+	if current, _ := publicKey(cfg.PrivateKey); current == next {
+		log.Error().Msgf("nextPrivateKey for %v is the key already in use", cfg.Name)
+		return false
+	}
+
+	switchAt := time.Now().Add(switchDelay())
+	if vars.SwitchAt != "" {
+		switchAt, err = time.Parse(time.RFC3339, vars.SwitchAt)
+		if err != nil {
+			log.Error().Err(err).Msg("--at must be an RFC 3339 time such as 2026-11-01T02:00:00Z")
+			return false
+		}
+	}
+
+	record := serverKeyRecord{
+		Pubkey:    serverKeyKey(cfg.Name),
+		Server:    cfg.Name,
+		PublicKey: next,
+		Staged:    time.Now().Unix(),
+		SwitchAt:  switchAt.Unix(),
+	}
+	// A staged rotation has to finish or be cancelled before the next one
+	stored, err := putStateIfAbsent(record, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to stage server key")
+		return false
+	}
+	if !stored {
+		log.Error().Msgf("A server key rotation for %v is already staged, cancel it first", cfg.Name)
+		return false
+	}
+	log.Info().Msgf("New key %v staged for %v, switching at %v", next, cfg.Name, switchAt.Format(time.RFC3339))
+	return true
+}
+
+// Drop a staged server key that has not been switched to yet
+func CancelServerKey(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("cancel-server-key", "", ok, vars.Server) }()
+	cfg, err := server.Get(vars.Server)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find server")
+		return false
+	}
+	record, found, err := stagedKey(cfg.Name, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read staged key")
+		return false
+	}
+	if !found {
+		log.Error().Msgf("No server key rotation is staged for %v", cfg.Name)
+		return false
+	}
+	if time.Now().Unix() >= record.SwitchAt {
+		log.Error().Msgf("%v already switched to the new key, put it in the config instead", cfg.Name)
+		return false
+	}
+	if err := clearServerKey(cfg.Name, svc); err != nil {
+		log.Error().Err(err).Msg("Unable to cancel server key rotation")
+		return false
+	}
+	log.Info().Msgf("Server key rotation for %v cancelled", cfg.Name)
+	return true
+}
+
+// Show a staged rotation and which users have their new config
+func ServerKeyStatus(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+	cfg, err := server.Get(vars.Server)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find server")
+		return false
+	}
+	record, found, err := stagedKey(cfg.Name, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read staged key")
+		return false
+	}
+	if !found {
+		fmt.Printf("No server key rotation is staged for %v\n", cfg.Name)
+		return true
+	}
+	deliveries, err := keyDeliveries(cfg.Name, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read deliveries")
+		return false
+	}
+	users, err := scanUsers(svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read users")
+		return false
+	}
+
+	state := "staged"
+	if time.Now().Unix() >= record.SwitchAt {
+		state = "switched"
+	}
+	local := "nextPrivateKey matches"
+	if next, err := publicKey(cfg.NextPrivateKey); err != nil || next != record.PublicKey {
+		local = "nextPrivateKey missing or different, this gateway won't switch"
+	}
+	fmt.Printf("Server:       %v\nNew key:      %v\nThis config:  %v\nStaged:       %v\nSwitch at:    %v (%v)\n\n", cfg.Name, record.PublicKey, local,
+		time.Unix(record.Staged, 0).Format(time.RFC3339), time.Unix(record.SwitchAt, 0).Format(time.RFC3339), state)
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Profile\tEmail\tNew config")
+	delivered := 0
+	current := rotationTargets(users, cfg)
+	for _, v := range current {
+		d, found := deliveries[v.Pubkey]
+		result := "pending"
+		switch {
+		case found && d.Delivered > 0:
+			result = "sent " + time.Unix(d.Delivered, 0).Format(time.RFC3339)
+			delivered++
+		case found:
+			result = fmt.Sprintf("failed %d times: %v", d.Attempts, d.Error)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", v.ProfileName, v.Email, result)
+	}
+	w.Flush()
+	fmt.Printf("\n%d of %d users have the new config\n", delivered, len(current))
+	return true
+}
+
+// The server config with the private key the interface should use:
+// nextPrivateKey once a staged rotation to it is due, otherwise privateKey
+func EffectiveServer(cfg server.Config, svc *dynamodb.DynamoDB) server.Config {
+	record, found, err := stagedKey(cfg.Name, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read staged server key, using the configured key")
+		return cfg
+	}
+	if !found || time.Now().Unix() < record.SwitchAt {
+		return cfg
+	}
+	if next, err := publicKey(cfg.NextPrivateKey); err == nil && next == record.PublicKey {
+		cfg.PrivateKey = cfg.NextPrivateKey
+	} else if current, _ := publicKey(cfg.PrivateKey); current != record.PublicKey {
+		log.Error().Msgf("%v is due to switch to %v but nextPrivateKey doesn't match, keeping the current key", cfg.Name, record.PublicKey)
+	}
+	return cfg
+}
+
+// The public key for a private key from the config
+func publicKey(privateKey string) (string, error) {
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return key.PublicKey().String(), nil
+}
+
+func switchDelay() time.Duration {
+	if delay := viper.GetInt("serverKeys.switchDelay"); delay > 0 {
+		return time.Second * time.Duration(delay)
+	}
+	return defaultSwitchDelay
+}
+
+func stagedKey(name string, svc *dynamodb.DynamoDB) (serverKeyRecord, bool, error) {
+	record := serverKeyRecord{}
+	found, err := getState(serverKeyKey(name), &record, svc)
+	if err == nil && found && record.PublicKey == "" {
+		err = fmt.Errorf("the rotation staged for %v holds a private key, cancel it and stage it again", name)
+	}
+	return record, found, err
+}
+
+func keyDeliveries(name string, svc *dynamodb.DynamoDB) (map[string]keyDeliveryRecord, error) {
+	records := []keyDeliveryRecord{}
+	if err := scanState(keyDeliveryKey(name, ""), &records, svc); err != nil {
+		return nil, err
+	}
+	byOwner := map[string]keyDeliveryRecord{}
+	for _, v := range records {
+		byOwner[v.Owner] = v
+	}
+	return byOwner, nil
+}
+
+// Users of a server that need the new config; retiring keys are skipped, and
+// disabled users get theirs once enabled
+func rotationTargets(users []User, cfg server.Config) []User {
+	targets := []User{}
+	for _, v := range onServer(users, cfg) {
+		if v.ReplacedBy == "" && !v.Disabled() {
+			targets = append(targets, v)
+		}
+	}
+	return targets
+}
+
+func clearServerKey(name string, svc *dynamodb.DynamoDB) error {
+	if _, err := deleteStatePrefix(keyDeliveryKey(name, ""), svc); err != nil {
+		return err
+	}
+	return deleteState(serverKeyKey(name), svc)
+}
+
+// Leader task: send configs with the staged key to users that have not had
+// one, and finish the rotation once the config file carries the new key
+func deliverServerKeys(svc *dynamodb.DynamoDB) error {
+	servers, err := server.All()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, cfg := range servers {
+		if err := deliverServerKey(cfg, svc); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", cfg.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func deliverServerKey(cfg server.Config, svc *dynamodb.DynamoDB) error {
+	record, found, err := stagedKey(cfg.Name, svc)
+	if err != nil || !found {
+		return err
+	}
+	switchAt := time.Unix(record.SwitchAt, 0)
+	if current, _ := publicKey(cfg.PrivateKey); current == record.PublicKey {
+		log.Info().Msgf("Config for %v carries the new key, server key rotation finished", cfg.Name)
+		audit.Admin("rotate-server-key", "", true, cfg.Name+" finished")
+		return clearServerKey(cfg.Name, svc)
+	}
+	if time.Now().After(switchAt) {
+		log.Warn().Msgf("%v switched to its new server key, move nextPrivateKey to privateKey in the config to finish the rotation", cfg.Name)
+	}
+	// Configs are built from the key in this gateway's config
+	if next, err := publicKey(cfg.NextPrivateKey); err != nil || next != record.PublicKey {
+		log.Warn().Msgf("nextPrivateKey for %v doesn't match the staged key, configs with the new key can't be delivered", cfg.Name)
+		return nil
+	}
+	if !viper.GetBool("smtp.enabled") {
+		log.Warn().Msgf("SMTP is disabled, configs with the new key for %v can't be delivered", cfg.Name)
+		return nil
+	}
+
+	deliveries, err := keyDeliveries(cfg.Name, svc)
+	if err != nil {
+		return err
+	}
+	users, err := scanUsers(svc)
+	if err != nil {
+		return err
+	}
+	maxAttempts := viper.GetInt("serverKeys.deliveryAttempts")
+	if maxAttempts <= 0 {
+		maxAttempts = defaultDeliveryAttempts
+	}
+	staged := cfg
+	staged.PrivateKey = cfg.NextPrivateKey
+	note := "The VPN server key changes at " + switchAt.Format(time.RFC1123) + ". Import the attached config now; " +
+		"it starts working at that time and replaces your current one.\n\n"
+	if time.Now().After(switchAt) {
+		note = "The VPN server key has changed. Import the attached config to keep connecting.\n\n"
+	}
+
+	for _, v := range rotationTargets(users, cfg) {
+		d, found := deliveries[v.Pubkey]
+		if found && (d.Delivered > 0 || d.Attempts >= maxAttempts) {
+			continue
+		}
+		d.Pubkey = keyDeliveryKey(cfg.Name, v.Pubkey)
+		d.Owner = v.Pubkey
+		d.Profile = v.ProfileName
+		d.Attempts++
+		if err := sendConfig(v, staged, note); err != nil {
+			log.Error().Err(err).Msgf("Unable to send new server key config to %v", v.Email)
+			d.Error = err.Error()
+		} else {
+			d.Delivered = time.Now().Unix()
+			d.Error = ""
+		}
+		if err := putState(d, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRotateServerKey(t *testing.T) {
+	table, svc := newFakeTable(t)
+	current, _ := wgtypes.GeneratePrivateKey()
+	next, _ := wgtypes.GeneratePrivateKey()
+	viper.Set("server.wgInterface", "wg0")
+	viper.Set("ipPoolStart", "172.20.0.2")
+	viper.Set("server.privateKey", current.String())
+	viper.Set("server.nextPrivateKey", next.String())
+	t.Cleanup(func() {
+		for _, k := range []string{"server.wgInterface", "ipPoolStart", "server.privateKey", "server.nextPrivateKey"} {
+			viper.Set(k, nil)
+		}
+	})
+
+	if !RotateServerKey(&util.CmdVars{SwitchAt: time.Now().Add(-time.Minute).Format(time.RFC3339)}, svc) {
+		t.Fatal("staging failed")
+	}
+	record := map[string]interface{}{}
+	if !table.get(t, serverKeyKey(server.DefaultName), &record) {
+		t.Fatal("nothing staged")
+	}
+	for k, v := range record {
+		if s, ok := v.(string); ok && (s == next.String() || strings.Contains(k, "Private")) {
+			t.Errorf("staged record holds the private key in %v", k)
+		}
+	}
+	if record["PublicKey"] != next.PublicKey().String() {
+		t.Errorf("staged %v, want %v", record["PublicKey"], next.PublicKey())
+	}
+
+	cfg, err := server.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := EffectiveServer(cfg, svc).PrivateKey; got != next.String() {
+		t.Error("did not switch to nextPrivateKey after the switch time")
+	}
+	// A gateway whose config lacks the key keeps its current one
+	cfg.NextPrivateKey = ""
+	if got := EffectiveServer(cfg, svc).PrivateKey; got != current.String() {
+		t.Error("switched without a matching nextPrivateKey")
+	}
+}
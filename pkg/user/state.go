@@ -0,0 +1,236 @@
+package user
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Auxiliary records (grace windows, lockouts, ...) live in the user table next
+// to the users. Their keys are "<kind>#<id>"; '#' never appears in a base64
+// public key, which is how scan tells them apart from users. Expires holds a
+// unix timestamp and doubles as the table's TTL attribute.
+const stateSep = "#"
+
+func stateKey(kind string, parts ...string) string {
+	return kind + stateSep + strings.Join(parts, stateSep)
+}
+
+// Write a state record. The item must have Pubkey set to a stateKey.
+func putState(item interface{}, svc *dynamodb.DynamoDB) error {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+	})
+	return err
+}
+
+// Write a state record unless an unexpired one with the same key exists.
+// Returns false when another writer got there first.
+func putStateIfAbsent(item interface{}, svc *dynamodb.DynamoDB) (bool, error) {
+	return putStateIf(item, "attribute_not_exists(Pubkey) OR Expires <= :now", nil, svc)
+}
+
+// Write a state record if condition holds. :now is bound to the current unix
+// time in addition to values.
+func putStateIf(item interface{}, condition string, values map[string]*dynamodb.AttributeValue, svc *dynamodb.DynamoDB) (bool, error) {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		return false, err
+	}
+	bound := map[string]*dynamodb.AttributeValue{
+		":now": {
+			N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+		},
+	}
+	for k, v := range values {
+		bound[k] = v
+	}
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item:                      av,
+		TableName:                 aws.String(viper.GetString("dynamoDBTable")),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: bound,
+	})
+	if conditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func conditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// Whether a transaction was cancelled because the condition on item i failed
+func transactionConflict(err error, i int) bool {
+	var cancelled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &cancelled) || i >= len(cancelled.CancellationReasons) {
+		return false
+	}
+	return aws.StringValue(cancelled.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
+
+// Read a state record into out. Expired records that TTL has not removed yet
+// are reported as missing.
+func getState(key string, out interface{}, svc *dynamodb.DynamoDB) (bool, error) {
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(viper.GetString("dynamoDBTable")),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(key),
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(result.Item) == 0 || expired(result.Item) {
+		return false, nil
+	}
+	return true, dynamodbattribute.UnmarshalMap(result.Item, out)
+}
+
+func deleteState(key string, svc *dynamodb.DynamoDB) error {
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(key),
+			},
+		},
+	})
+	return err
+}
+
+// Read every unexpired state record whose key starts with prefix into out,
+// a pointer to a slice
+func scanState(prefix string, out interface{}, svc *dynamodb.DynamoDB) error {
+	items := []map[string]*dynamodb.AttributeValue{}
+	err := svc.ScanPages(&dynamodb.ScanInput{
+		TableName:        aws.String(viper.GetString("dynamoDBTable")),
+		ConsistentRead:   aws.Bool(true),
+		FilterExpression: aws.String("begins_with(Pubkey, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {
+				S: aws.String(prefix),
+			},
+		},
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			if !expired(item) {
+				items = append(items, item)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return dynamodbattribute.UnmarshalListOfMaps(items, out)
+}
+
+// Delete every state record whose key starts with prefix
+func deleteStatePrefix(prefix string, svc *dynamodb.DynamoDB) (int, error) {
+	deleted := 0
+	err := svc.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(viper.GetString("dynamoDBTable")),
+		FilterExpression:     aws.String("begins_with(Pubkey, :prefix)"),
+		ProjectionExpression: aws.String("Pubkey"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {
+				S: aws.String(prefix),
+			},
+		},
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			if deleteState(aws.StringValue(item["Pubkey"].S), svc) == nil {
+				deleted++
+			}
+		}
+		return true
+	})
+	return deleted, err
+}
+
+// Atomically add one to a counter attribute and return the new value
+func incrState(key string, attr string, expires int64, svc *dynamodb.DynamoDB) (int, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(viper.GetString("dynamoDBTable")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Pubkey": {
+				S: aws.String(key),
+			},
+		},
+		UpdateExpression: aws.String("ADD #count :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#count": aws.String(attr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {
+				N: aws.String("1"),
+			},
+		},
+		ReturnValues: aws.String("UPDATED_NEW"),
+	}
+	// Counters without an expiry are kept forever
+	if expires > 0 {
+		input.UpdateExpression = aws.String("ADD #count :one SET Expires = :expires")
+		input.ExpressionAttributeValues[":expires"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(expires, 10)),
+		}
+	}
+	result, err := svc.UpdateItem(input)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := result.Attributes[attr]
+	if !ok || v.N == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(*v.N)
+}
+
+// Remove every state record kept for a public key
+func deleteUserState(pubkey string, svc *dynamodb.DynamoDB) {
+	if _, err := deleteStatePrefix(stateKey("grace", pubkey), svc); err != nil {
+		log.Error().Err(err).Msg("Unable to remove grace records")
+	}
+	if _, err := deleteStatePrefix(stateKey("rate", "key", pubkey), svc); err != nil {
+		log.Error().Err(err).Msg("Unable to remove rate limit counters")
+	}
+	if _, err := deleteStatePrefix(stateKey("notice", pubkey), svc); err != nil {
+		log.Error().Err(err).Msg("Unable to remove notices")
+	}
+	for _, kind := range []string{"lastauth", "failures", "lockout"} {
+		if err := deleteState(stateKey(kind, pubkey), svc); err != nil {
+			log.Error().Err(err).Msgf("Unable to remove %v record", kind)
+		}
+	}
+}
+
+func expired(item map[string]*dynamodb.AttributeValue) bool {
+	v, ok := item["Expires"]
+	if !ok || v.N == nil {
+		return false
+	}
+	ts, err := strconv.ParseInt(*v.N, 10, 64)
+	if err != nil || ts == 0 {
+		return false
+	}
+	return time.Now().Unix() >= ts
+}
@@ -0,0 +1,124 @@
+package user
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Status of a user that may not connect. Sync drops the peer and firewall
+// chain but the record, address and keys are kept for enable.
+const StatusDisabled = "disabled"
+
+// Whether the user has been disabled
+func (u User) Disabled() bool {
+	return u.Status == StatusDisabled
+}
+
+// Cut a user off without removing them
+func Disable(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("disable", vars.ProfileName, ok, vars.Reason) }()
+	user, err := getUser(vars, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+	if user.Disabled() {
+		log.Info().Msg(vars.ProfileName + " is already disabled")
+		return true
+	}
+	if err := setStatus(user, StatusDisabled, vars.Reason, svc); err != nil {
+		log.Error().Err(err).Msgf("Unable to disable %v", vars.ProfileName)
+		return false
+	}
+	log.Info().Msg(vars.ProfileName + " succesfully disabled")
+	return true
+}
+
+// Let a disabled user connect again
+func Enable(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("enable", vars.ProfileName, ok, vars.Reason) }()
+	user, err := getUser(vars, svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to find user")
+		return false
+	}
+	if !user.Disabled() {
+		log.Info().Msg(vars.ProfileName + " is not disabled")
+		return true
+	}
+	if err := setStatus(user, "", vars.Reason, svc); err != nil {
+		log.Error().Err(err).Msgf("Unable to enable %v", vars.ProfileName)
+		return false
+	}
+	log.Info().Msg(vars.ProfileName + " succesfully enabled")
+	return true
+}
+
+// Users that have not been disabled
+func enabled(users []User) []User {
+	active := []User{}
+	for _, v := range users {
+		if !v.Disabled() {
+			active = append(active, v)
+		}
+	}
+	return active
+}
+
+// Set the status of a user and of any key still retiring after a rotation,
+// which would otherwise keep connecting until the overlap ends
+func setStatus(user User, status string, reason string, svc *dynamodb.DynamoDB) error {
+	records := []User{user}
+	retiring, found, err := retiringKey(user, svc)
+	if err != nil {
+		return err
+	}
+	if found {
+		records = append(records, retiring)
+	}
+	var errs []error
+	for _, v := range records {
+		_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(viper.GetString("dynamoDBTable")),
+			Key: map[string]*dynamodb.AttributeValue{
+				"Pubkey": {
+					S: aws.String(v.Pubkey),
+				},
+			},
+			UpdateExpression:    aws.String("set #status = :status, StatusReason = :reason, StatusChanged = :changed"),
+			ConditionExpression: aws.String("attribute_exists(Pubkey)"),
+			// Aliased because STATUS is a reserved word
+			ExpressionAttributeNames: map[string]*string{
+				"#status": aws.String("Status"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":status": {
+					S: aws.String(status),
+				},
+				":reason": {
+					S: aws.String(reason),
+				},
+				":changed": {
+					N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+				},
+			},
+		})
+		// Retired in the meantime
+		if conditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
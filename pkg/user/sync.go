@@ -1,21 +1,62 @@
 package user
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/metrics"
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
 	"github.com/derrickmartinez/wireguard-auth/pkg/util"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func Sync(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+// State carried between sync iterations of one server
+type syncer struct {
+	svc       *dynamodb.DynamoDB
+	wgClient  *wgctrl.Client
+	ipt       *iptables.IPTables
+	name      string
+	server    server.Config
+	prevUsers []User
+	// Routes each chain was last built with, to catch grants ending
+	prevRoutes map[string]string
+	// Rewrite every user's firewall chain on the next run
+	reapply bool
+	status  *syncStatus
+	// Wakes the loop early: nil to sync now, a config after a reload
+	wake chan *server.Config
+	// Closed when the loop exits
+	stopped chan struct{}
+}
+
+// Held for reading while an iteration runs and for writing while the config
+// reloads, so no server syncs against a half-read config
+var configMu sync.RWMutex
+
+// Keep wireguard and the firewall in line with the table for every server
+// until ctx is done or a termination signal arrives
+func Sync(ctx context.Context, vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
+	servers, err := server.All()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid server config")
+		return false
+	}
+
 	wgClient, err := wgctrl.New()
 	if err != nil {
 		log.Error().Err(err).Msg("Error creating client")
@@ -28,67 +69,320 @@ func Sync(vars *util.CmdVars, svc *dynamodb.DynamoDB) bool {
 		return false
 	}
 
-	wgDevice := viper.GetString("server.wgInterface")
-	prevUsers := []User{}
-	curUsers := []User{}
+	syncers := []*syncer{}
+	for _, cfg := range servers {
+		syncers = append(syncers, &syncer{
+			svc:        svc,
+			wgClient:   wgClient,
+			ipt:        ipt,
+			name:       cfg.Name,
+			server:     cfg,
+			prevUsers:  []User{},
+			prevRoutes: map[string]string{},
+			// Rewrite chains from earlier runs so they all carry the managed-by marker
+			reapply: true,
+			status:  statuses.add(cfg.Name),
+			wake:    make(chan *server.Config),
+			stopped: make(chan struct{}),
+		})
+	}
 
-	for {
-		curUsers = scan(false, svc)
-		curUsersMap := usersMap(curUsers)
-		prevUsersMap := usersMap(prevUsers)
-		peerConfig := []wgtypes.PeerConfig{}
+	if addr := viper.GetString("httpListen"); addr != "" {
+		go serveHTTP(addr)
+	}
 
-		d, err := wgClient.Device(wgDevice)
-		if err != nil {
-			log.Error().Err(err).Msg("Error getting wireguard device")
-			return false
-		}
+	// Signals are only acted on between iterations, so the firewall is never
+	// left half rewritten
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
 
-		// Check to see if any peers need removing
-		for _, v := range d.Peers {
-			if curUsersMap[v.PublicKey.String()].Privkey == "" {
-				config := removePeer(v, ipt)
-				peerConfig = Append(peerConfig, config)
-			}
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		peersMap := peersMap(d.Peers)
-		for _, v := range curUsers {
-			// Add missing peer
-			if !peersMap[v.Pubkey] {
-				config := addPeer(v, ipt)
-				peerConfig = Append(peerConfig, config)
+	// Consecutive failed iterations tolerated before giving up, 0 never gives up
+	maxFailures := viper.GetInt("syncMaxFailures")
+	failed := make(chan string, len(syncers))
+	var wg sync.WaitGroup
+	for _, s := range syncers {
+		wg.Add(1)
+		go func(s *syncer) {
+			defer wg.Done()
+			defer close(s.stopped)
+			if !s.loop(ctx, maxFailures) {
+				failed <- s.name
 			}
-			// Update routes if changed
-			if v.Serial > prevUsersMap[v.Pubkey].Serial {
-				updateRoutes(v, ipt)
+		}(s)
+	}
+
+	// One gateway at a time runs the singleton tasks
+	l := &leader{svc: svc}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.loop(ctx)
+	}()
+
+	ok := true
+	running := true
+	for running {
+		select {
+		case <-ctx.Done():
+			running = false
+		case name := <-failed:
+			log.Error().Msgf("Stopping all servers after %v gave up", name)
+			ok = false
+			running = false
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				reload(ctx, syncers)
+			case syscall.SIGUSR1:
+				log.Info().Msg("Sync requested")
+				for _, s := range syncers {
+					s.notify(ctx, nil)
+				}
+			default:
+				log.Info().Msgf("Received %v, shutting down", sig)
+				running = false
 			}
 		}
+	}
+	cancel()
+	wg.Wait()
+	log.Info().Msg("Sync stopped")
 
-		// Process changes
-		if len(peerConfig) > 0 {
-			key, err := wgtypes.ParseKey(viper.GetString("server.privateKey"))
-			if err != nil {
-				log.Error().Err(err)
-			}
-			port := viper.GetInt("server.port")
-			config := wgtypes.Config{
-				PrivateKey:   &key,
-				ListenPort:   &port,
-				ReplacePeers: false,
-				Peers:        peerConfig,
+	if vars.TeardownOnExit {
+		log.Info().Msg("Removing managed peers and firewall chains")
+		devices := []string{}
+		users := []User{}
+		for _, s := range syncers {
+			devices = append(devices, s.server.WgInterface)
+			users = append(users, s.prevUsers...)
+		}
+		torn := teardown(wgClient, ipt, devices, users)
+		audit.Admin("teardown", "", torn, "sync exit")
+		return ok && torn
+	}
+	return ok
+}
+
+// Re-read the config file and hand every server its new settings. Servers
+// added to or removed from the list take effect on restart.
+func reload(ctx context.Context, syncers []*syncer) {
+	log.Info().Msg("Reloading config")
+	configMu.Lock()
+	err := viper.ReadInConfig()
+	var servers []server.Config
+	if err == nil {
+		servers, err = server.All()
+	}
+	configMu.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reload config, keeping the current one")
+		return
+	}
+
+	byName := map[string]server.Config{}
+	for _, v := range servers {
+		byName[v.Name] = v
+	}
+	for _, s := range syncers {
+		cfg, found := byName[s.name]
+		if !found {
+			log.Warn().Msgf("Server %v is no longer configured, it keeps running until restart", s.name)
+			continue
+		}
+		delete(byName, s.name)
+		s.notify(ctx, &cfg)
+	}
+	for name := range byName {
+		log.Warn().Msgf("Server %v starts on the next restart", name)
+	}
+}
+
+// Wake a server's loop unless it already stopped
+func (s *syncer) notify(ctx context.Context, cfg *server.Config) {
+	select {
+	case s.wake <- cfg:
+	case <-s.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// Sync one server until ctx is done. Returns false after too many
+// consecutive failures.
+func (s *syncer) loop(ctx context.Context, maxFailures int) bool {
+	for {
+		start := time.Now()
+		configMu.RLock()
+		err := s.run()
+		interval := time.Second * time.Duration(viper.GetInt("syncInterval"))
+		configMu.RUnlock()
+		s.status.record(err)
+		metrics.ObserveSync(s.name, start)
+		if err != nil {
+			log.Error().Err(err).Str("server", s.name).Msg("Sync failed")
+			metrics.SyncErrors.WithLabelValues(s.name).Inc()
+			if failures := s.status.failures(); maxFailures > 0 && failures >= maxFailures {
+				log.Error().Str("server", s.name).Msgf("Giving up after %d consecutive failures", failures)
+				return false
 			}
-			err = wgClient.ConfigureDevice(wgDevice, config)
-			if err != nil {
-				log.Error().Err(err).Msg("Error configuring wireguard device")
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return true
+		case <-timer.C:
+		case cfg := <-s.wake:
+			timer.Stop()
+			if cfg != nil {
+				// Rule profiles and allowInternet may have changed for anyone
+				s.server = *cfg
+				s.reapply = true
 			}
 		}
+	}
+}
+
+// One pass reconciling a server's interface and firewall with the store
+func (s *syncer) run() error {
+	allUsers, err := scanUsers(s.svc)
+	s.status.setStore(err == nil)
+	if err != nil {
+		// Never treat an unreadable table as empty, that would drop every peer
+		return fmt.Errorf("reading users: %w", err)
+	}
+	// Expired and disabled users are dropped like removed ones but keep their record
+	curUsers := enabled(unexpired(onServer(allUsers, s.server), time.Now()))
+	// Picks up a staged server key once its switch time passes
+	cfg := EffectiveServer(s.server, s.svc)
+	curUsersMap := usersMap(curUsers)
+	prevUsersMap := usersMap(s.prevUsers)
+	peerConfig := []wgtypes.PeerConfig{}
+
+	// Recreates the interface if something removed it since the last run
+	if cfg.ManageInterface {
+		if err := server.EnsureInterface(cfg); err != nil {
+			s.status.setInterface(false)
+			return fmt.Errorf("setting up wireguard interface: %w", err)
+		}
+	}
 
-		prevUsers = curUsers
-		time.Sleep(time.Second * time.Duration(viper.GetInt("syncInterval")))
+	d, err := s.wgClient.Device(s.server.WgInterface)
+	s.status.setInterface(err == nil)
+	if err != nil {
+		return fmt.Errorf("getting wireguard device: %w", err)
+	}
+	updateMetrics(s.server.Name, curUsers, d.Peers, s.svc)
+	if err := reportGateway(s.server.Name, d.Peers, s.svc); err != nil {
+		log.Error().Err(err).Msg("Unable to publish gateway status")
 	}
 
-	return false
+	// Keys being rotated share an address, see addressHolders
+	handshakes := map[string]time.Time{}
+	holding := map[string]bool{}
+	for _, v := range d.Peers {
+		handshakes[v.PublicKey.String()] = v.LastHandshakeTime
+		holding[v.PublicKey.String()] = len(v.AllowedIPs) > 0
+	}
+	holders := addressHolders(curUsers, handshakes)
+	inUse := map[string]bool{}
+	for ip := range holders {
+		inUse[util.Int2ip(ip).String()] = true
+	}
+
+	// Check to see if any peers need removing
+	for _, v := range d.Peers {
+		if curUsersMap[v.PublicKey.String()].Privkey == "" {
+			config := removePeer(v, inUse, s.ipt)
+			peerConfig = Append(peerConfig, config)
+		}
+	}
+
+	peersMap := peersMap(d.Peers)
+	routesNow := map[string]string{}
+	for _, v := range curUsers {
+		holds := holders[v.Clientip] == v.Pubkey
+		// A retiring key uses the firewall chain of the key replacing it
+		owner := v.ReplacedBy == "" || curUsersMap[v.ReplacedBy].Pubkey == ""
+		// Add missing peer
+		if !peersMap[v.Pubkey] {
+			config := addPeer(v, holds, owner, cfg, s.ipt)
+			peerConfig = Append(peerConfig, config)
+		} else if holds != holding[v.Pubkey] {
+			peerConfig = Append(peerConfig, moveAddress(v, holds))
+		}
+		if !owner {
+			continue
+		}
+		// Update routes if changed, or a grant started or ended
+		routes := activeRoutes(v, cfg)
+		prev, built := s.prevRoutes[v.Pubkey]
+		if v.Serial > prevUsersMap[v.Pubkey].Serial || (s.reapply && peersMap[v.Pubkey]) || (built && prev != routes) {
+			updateRoutes(v, cfg, s.ipt)
+		}
+		routesNow[v.Pubkey] = routes
+	}
+	s.reapply = false
+	s.prevRoutes = routesNow
+
+	key, err := wgtypes.ParseKey(cfg.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("parsing server key: %w", err)
+	}
+
+	// Process changes
+	if len(peerConfig) > 0 || d.PrivateKey != key {
+		if d.PrivateKey != key {
+			log.Info().Msgf("Switching %v to server key %v", cfg.WgInterface, key.PublicKey())
+		}
+		port := cfg.Port
+		config := wgtypes.Config{
+			PrivateKey:   &key,
+			ListenPort:   &port,
+			ReplacePeers: false,
+			Peers:        peerConfig,
+		}
+		err = s.wgClient.ConfigureDevice(s.server.WgInterface, config)
+		if err != nil {
+			return fmt.Errorf("configuring wireguard device: %w", err)
+		}
+	}
+
+	s.prevUsers = curUsers
+	return nil
+}
+
+// Refresh the gauges exported on /metrics for one server
+func updateMetrics(name string, users []User, peers []wgtypes.Peer, svc *dynamodb.DynamoDB) {
+	window := handshakeWindow()
+	profiles := usersMap(users)
+
+	active := 0
+	metrics.PeerReceiveBytes.DeletePartialMatch(prometheus.Labels{"server": name})
+	metrics.PeerTransmitBytes.DeletePartialMatch(prometheus.Labels{"server": name})
+	for _, v := range peers {
+		if time.Since(v.LastHandshakeTime) < window {
+			active++
+		}
+		pubkey := v.PublicKey.String()
+		profile := profiles[pubkey].ProfileName
+		metrics.PeerReceiveBytes.WithLabelValues(name, profile, pubkey).Set(float64(v.ReceiveBytes))
+		metrics.PeerTransmitBytes.WithLabelValues(name, profile, pubkey).Set(float64(v.TransmitBytes))
+	}
+	metrics.Users.WithLabelValues(name).Set(float64(len(users)))
+	metrics.Peers.WithLabelValues(name).Set(float64(len(peers)))
+	metrics.PeersActive.WithLabelValues(name).Set(float64(active))
+
+	counts, err := ResultCounts(svc)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read MFA result counts")
+		return
+	}
+	metrics.SetMFAResults(counts)
 }
 
 func Extend(slice []wgtypes.PeerConfig, element wgtypes.PeerConfig) []wgtypes.PeerConfig {
@@ -126,16 +420,15 @@ func peersMap(peers []wgtypes.Peer) map[string]bool {
 	return localMap
 }
 
-func removePeer(peer wgtypes.Peer, ipt *iptables.IPTables) wgtypes.PeerConfig {
+// Remove a peer, and its firewall chain unless another key now uses the address
+func removePeer(peer wgtypes.Peer, inUse map[string]bool, ipt *iptables.IPTables) wgtypes.PeerConfig {
 	log.Info().Msgf("Remove %v from local", peer.PublicKey)
-	peerIP := peer.AllowedIPs[0].String()
-	removeIP, _, err := net.ParseCIDR(peerIP)
-	if err != nil {
-		log.Error().Err(err)
+	for _, v := range peer.AllowedIPs {
+		if !inUse[v.IP.String()] {
+			clearIPTables(v.IP.String(), ipt)
+		}
 	}
 
-	clearIPTables(removeIP.String(), ipt)
-
 	peerConfig := wgtypes.PeerConfig{
 		PublicKey: peer.PublicKey,
 		Remove:    true,
@@ -144,24 +437,21 @@ func removePeer(peer wgtypes.Peer, ipt *iptables.IPTables) wgtypes.PeerConfig {
 	return peerConfig
 }
 
-func addPeer(peer User, ipt *iptables.IPTables) wgtypes.PeerConfig {
+// Add a peer. Only the key holding the address gets it, and only the key
+// owning the firewall chain rebuilds it.
+func addPeer(peer User, holds bool, owner bool, cfg server.Config, ipt *iptables.IPTables) wgtypes.PeerConfig {
 	log.Info().Msgf("Add %v to local", peer.Pubkey)
-	// Clear in case it already exists from a previous process
-	clearIPTables(util.Int2ip(peer.Clientip).String(), ipt)
-	addIPTables(peer, ipt)
+	if owner {
+		// Clear in case it already exists from a previous process
+		clearIPTables(util.Int2ip(peer.Clientip).String(), ipt)
+		addIPTables(peer, cfg, ipt)
+	}
 
 	psk, err := wgtypes.ParseKey(peer.Psk)
 	if err != nil {
 		log.Error().Err(err)
 	}
 
-	clientip := []net.IPNet{
-		net.IPNet{
-			IP:   util.Int2ip(peer.Clientip),
-			Mask: net.IPv4Mask(255, 255, 255, 255),
-		},
-	}
-
 	pubkey, err := wgtypes.ParseKey(peer.Pubkey)
 	if err != nil {
 		log.Error().Err(err)
@@ -170,70 +460,101 @@ func addPeer(peer User, ipt *iptables.IPTables) wgtypes.PeerConfig {
 	peerConfig := wgtypes.PeerConfig{
 		PublicKey:    pubkey,
 		PresharedKey: &psk,
-		AllowedIPs:   clientip,
+		AllowedIPs:   peerAddress(peer, holds),
 	}
 
 	return peerConfig
 }
 
-func updateRoutes(peer User, ipt *iptables.IPTables) {
+// Hand a key's address to it or take it away
+func moveAddress(peer User, holds bool) wgtypes.PeerConfig {
+	if holds {
+		log.Info().Msgf("Move %v to %v", util.Int2ip(peer.Clientip), peer.Pubkey)
+	}
+	pubkey, err := wgtypes.ParseKey(peer.Pubkey)
+	if err != nil {
+		log.Error().Err(err)
+	}
+	return wgtypes.PeerConfig{
+		PublicKey:         pubkey,
+		UpdateOnly:        true,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        peerAddress(peer, holds),
+	}
+}
+
+// A key without the address can still handshake, which is how the new key
+// of a rotation shows it is in use
+func peerAddress(peer User, holds bool) []net.IPNet {
+	if !holds {
+		return nil
+	}
+	return []net.IPNet{
+		net.IPNet{
+			IP:   util.Int2ip(peer.Clientip),
+			Mask: net.IPv4Mask(255, 255, 255, 255),
+		},
+	}
+}
+
+func updateRoutes(peer User, cfg server.Config, ipt *iptables.IPTables) {
 	log.Info().Msgf("Update routes for %v", peer.Pubkey)
 	clearIPTables(util.Int2ip(peer.Clientip).String(), ipt)
-	addIPTables(peer, ipt)
+	addIPTables(peer, cfg, ipt)
 }
 
-func addIPTables(user User, ipt *iptables.IPTables) bool {
-	extInterface := viper.GetString("server.extInterface")
+func addIPTables(user User, cfg server.Config, ipt *iptables.IPTables) bool {
+	extInterface := cfg.ExtInterface
 	ip := util.Int2ip(user.Clientip).String()
 	err := ipt.NewChain("filter", ip)
 	if err != nil {
-		log.Error().Err(err)
+		firewallError(err)
 		return false
 	}
-	routes := strings.Split(user.Routesallow, ",")
+	routes := strings.Split(activeRoutes(user, cfg), ",")
 	for _, v := range routes {
 		v := strings.Split(v, "->")
 		destIP := v[0]
 		if len(v) > 1 {
 			v := strings.Split(v[1], "/")
-			err = ipt.Append("filter", ip, "-s", ip+"/32", "-p", v[1], "--dport", v[0], "-d", destIP, "-o", extInterface, "-j", "ACCEPT")
+			err = ipt.Append("filter", ip, marked("-s", ip+"/32", "-p", v[1], "--dport", v[0], "-d", destIP, "-o", extInterface, "-j", "ACCEPT")...)
 			if err != nil {
-				log.Error().Err(err)
+				firewallError(err)
 				return false
 			}
 		} else {
-			err = ipt.Append("filter", ip, "-s", ip+"/32", "-d", destIP, "-o", extInterface, "-j", "ACCEPT")
+			err = ipt.Append("filter", ip, marked("-s", ip+"/32", "-d", destIP, "-o", extInterface, "-j", "ACCEPT")...)
 			if err != nil {
-				log.Error().Err(err)
+				firewallError(err)
 				return false
 			}
 		}
 	}
-	if !user.Splittunnel && viper.GetBool("allowInternet") {
-		err = ipt.Append("filter", ip, "-s", ip+"/32", "-d", "10.0.0.0/8", "-o", extInterface, "-j", "DROP")
+	if !user.Splittunnel && cfg.AllowInternet {
+		err = ipt.Append("filter", ip, marked("-s", ip+"/32", "-d", "10.0.0.0/8", "-o", extInterface, "-j", "DROP")...)
 		if err != nil {
-			log.Error().Err(err)
+			firewallError(err)
 			return false
 		}
-		err = ipt.Append("filter", ip, "-s", ip+"/32", "-d", "172.16.0.0/12", "-o", extInterface, "-j", "DROP")
+		err = ipt.Append("filter", ip, marked("-s", ip+"/32", "-d", "172.16.0.0/12", "-o", extInterface, "-j", "DROP")...)
 		if err != nil {
-			log.Error().Err(err)
+			firewallError(err)
 			return false
 		}
-		err = ipt.Append("filter", ip, "-s", ip+"/32", "-d", "192.168.0.0/16", "-o", extInterface, "-j", "DROP")
+		err = ipt.Append("filter", ip, marked("-s", ip+"/32", "-d", "192.168.0.0/16", "-o", extInterface, "-j", "DROP")...)
 		if err != nil {
-			log.Error().Err(err)
+			firewallError(err)
 			return false
 		}
-		err = ipt.Append("filter", ip, "-s", ip+"/32", "-d", "0.0.0.0/0", "-o", extInterface, "-j", "ACCEPT")
+		err = ipt.Append("filter", ip, marked("-s", ip+"/32", "-d", "0.0.0.0/0", "-o", extInterface, "-j", "ACCEPT")...)
 		if err != nil {
-			log.Error().Err(err)
+			firewallError(err)
 			return false
 		}
 	}
-	err = ipt.Insert("filter", "FORWARD", 1, "-j", ip)
+	err = ipt.Insert("filter", "FORWARD", 1, marked("-j", ip)...)
 	if err != nil {
-		log.Error().Err(err)
+		firewallError(err)
 		return false
 	}
 	return true
@@ -247,21 +568,43 @@ func clearIPTables(ip string, ipt *iptables.IPTables) bool {
 	}
 	err = ipt.ClearChain("filter", ip)
 	if err != nil {
-		log.Error().Err(err)
+		firewallError(err)
 		return false
 	}
-	err = ipt.Delete("filter", "FORWARD", "-j", ip)
-	if err != nil {
-		log.Error().Err(err)
+	// Chains from before rules were marked are jumped to without a comment
+	for _, spec := range [][]string{marked("-j", ip), {"-j", ip}} {
+		if exists, _ := ipt.Exists("filter", "FORWARD", spec...); exists {
+			err = ipt.Delete("filter", "FORWARD", spec...)
+			if err != nil {
+				firewallError(err)
+			}
+		}
 	}
 	err = ipt.DeleteChain("filter", ip)
 	if err != nil {
-		log.Error().Err(err)
+		firewallError(err)
 		return false
 	}
 	return true
 }
 
+// Comment attached to every rule wireguard-auth creates
+const managedBy = "managed-by=wireguard-auth"
+
+// Tag a rule spec ending in "-j <target>" so teardown can find it
+func marked(spec ...string) []string {
+	n := len(spec) - 2
+	out := append([]string{}, spec[:n]...)
+	out = append(out, "-m", "comment", "--comment", managedBy)
+	return append(out, spec[n:]...)
+}
+
+// Log a firewall failure and count it
+func firewallError(err error) {
+	log.Error().Err(err).Msg("Firewall error")
+	metrics.FirewallErrors.Inc()
+}
+
 func findChain(slice []string, val string) bool {
 	for _, item := range slice {
 		if item == val {
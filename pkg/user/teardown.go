@@ -0,0 +1,146 @@
+package user
+
+import (
+	"strings"
+
+	"github.com/derrickmartinez/wireguard-auth/pkg/audit"
+	"github.com/derrickmartinez/wireguard-auth/pkg/server"
+	"github.com/derrickmartinez/wireguard-auth/pkg/util"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/rs/zerolog/log"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Remove every peer and firewall chain wireguard-auth created on this host.
+// Users stay in the table.
+func Teardown(vars *util.CmdVars, svc *dynamodb.DynamoDB) (ok bool) {
+	defer func() { audit.Admin("teardown", "", ok, "") }()
+
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating client")
+		return false
+	}
+	defer wgClient.Close()
+
+	ipt, err := iptables.New()
+	if err != nil {
+		log.Error().Err(err).Msg("IP Tables error")
+		return false
+	}
+
+	users, err := scanUsers(svc)
+	if err != nil {
+		// Without the table there is no telling which peers are ours, and
+		// flushing their chains would leave them connected without filtering
+		log.Error().Err(err).Msg("Unable to read users, leaving peers and chains in place")
+		return false
+	}
+
+	servers, err := server.All()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid server config")
+		return false
+	}
+	devices := []string{}
+	for _, v := range servers {
+		devices = append(devices, v.WgInterface)
+	}
+	return teardown(wgClient, ipt, devices, users)
+}
+
+func teardown(wgClient *wgctrl.Client, ipt *iptables.IPTables, wgDevices []string, users []User) bool {
+	ok := true
+	known := usersMap(users)
+
+	for _, wgDevice := range wgDevices {
+		if !removePeers(wgClient, wgDevice, known) {
+			ok = false
+		}
+	}
+
+	chains, err := managedChains(ipt)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to list firewall chains")
+		return false
+	}
+	for _, v := range chains {
+		if !clearIPTables(v, ipt) {
+			ok = false
+		}
+	}
+	log.Info().Msgf("Removed %d firewall chains", len(chains))
+	return ok
+}
+
+// Remove the peers on a device that belong to users in the table
+func removePeers(wgClient *wgctrl.Client, wgDevice string, known map[string]User) bool {
+	d, err := wgClient.Device(wgDevice)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error getting wireguard device %v", wgDevice)
+		return false
+	}
+	peers := []wgtypes.PeerConfig{}
+	for _, v := range d.Peers {
+		if _, managed := known[v.PublicKey.String()]; !managed {
+			log.Warn().Msgf("Leaving peer %v, it is not in the table", v.PublicKey)
+			continue
+		}
+		peers = append(peers, wgtypes.PeerConfig{PublicKey: v.PublicKey, Remove: true})
+	}
+	if len(peers) == 0 {
+		return true
+	}
+	if err := wgClient.ConfigureDevice(wgDevice, wgtypes.Config{Peers: peers}); err != nil {
+		log.Error().Err(err).Msg("Error removing peers")
+		return false
+	}
+	log.Info().Msgf("Removed %d peers from %v", len(peers), wgDevice)
+	return true
+}
+
+// The part of *iptables.IPTables managedChains reads
+type chainLister interface {
+	ListChains(table string) ([]string, error)
+	List(table string, chain string) ([]string, error)
+}
+
+// Chains holding at least one rule tagged with the managed-by comment
+func managedChains(ipt chainLister) ([]string, error) {
+	chains, err := ipt.ListChains("filter")
+	if err != nil {
+		return nil, err
+	}
+	managed := []string{}
+	for _, chain := range chains {
+		switch chain {
+		case "INPUT", "FORWARD", "OUTPUT":
+			continue
+		}
+		rules, err := ipt.List("filter", chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if isMarked(rule) {
+				managed = append(managed, chain)
+				break
+			}
+		}
+	}
+	return managed, nil
+}
+
+// iptables may print the comment with or without quotes
+func isMarked(rule string) bool {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "--comment" && strings.Trim(fields[i+1], "\"") == managedBy {
+			return true
+		}
+	}
+	return false
+}
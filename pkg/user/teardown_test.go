@@ -0,0 +1,65 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsMarked(t *testing.T) {
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{`-A 172.20.0.2 -d 10.0.0.0/8 -m comment --comment managed-by=wireguard-auth -j ACCEPT`, true},
+		{`-A 172.20.0.2 -d 10.0.0.0/8 -m comment --comment "managed-by=wireguard-auth" -j ACCEPT`, true},
+		{`-A FORWARD -s 172.20.0.2/32 -m comment --comment managed-by=wireguard-auth -j 172.20.0.2`, true},
+		{`-A 172.20.0.2 -d 10.0.0.0/8 -j ACCEPT`, false},
+		{`-A DOCKER -m comment --comment "managed-by=wireguard-auth-legacy" -j RETURN`, false},
+		{`-A DOCKER -m comment --comment "not managed-by=wireguard-auth" -j RETURN`, false},
+		{`-N 172.20.0.2`, false},
+	}
+	for _, tt := range tests {
+		if got := isMarked(tt.rule); got != tt.want {
+			t.Errorf("isMarked(%q) = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+// Chains and their rules as iptables -S prints them
+type fakeChains map[string][]string
+
+func (f fakeChains) ListChains(table string) ([]string, error) {
+	chains := []string{"INPUT", "FORWARD", "OUTPUT"}
+	for k := range f {
+		if k != "FORWARD" {
+			chains = append(chains, k)
+		}
+	}
+	return chains, nil
+}
+
+func (f fakeChains) List(table string, chain string) ([]string, error) {
+	return append([]string{"-N " + chain}, f[chain]...), nil
+}
+
+func TestManagedChains(t *testing.T) {
+	chains := fakeChains{
+		"FORWARD":     {`-A FORWARD -s 172.20.0.2/32 -m comment --comment managed-by=wireguard-auth -j 172.20.0.2`},
+		"172.20.0.2":  {`-A 172.20.0.2 -d 10.0.0.0/8 -m comment --comment managed-by=wireguard-auth -j ACCEPT`, `-A 172.20.0.2 -j DROP`},
+		"172.20.0.3":  {`-A 172.20.0.3 -m comment --comment "managed-by=wireguard-auth" -j DROP`},
+		"10.99.0.1":   {`-A 10.99.0.1 -j ACCEPT`},
+		"DOCKER-USER": {`-A DOCKER-USER -j RETURN`},
+		"EMPTY":       nil,
+	}
+	got, err := managedChains(chains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, v := range got {
+		found[v] = true
+	}
+	if len(got) != 2 || !found["172.20.0.2"] || !found["172.20.0.3"] {
+		t.Errorf("managed chains %v, want 172.20.0.2 and 172.20.0.3", strings.Join(got, ", "))
+	}
+}